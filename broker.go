@@ -0,0 +1,348 @@
+package webson
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	brokerSubscribe   = "subscribe"
+	brokerUnsubscribe = "unsubscribe"
+	brokerPublish     = "publish"
+	brokerDeliver     = "message"
+)
+
+// broker frames are json objects with the "broker" field sent as TextMessage, so that browsers can talk to the broker too.
+// Other text messages are left to handlers of the connection.
+
+// brokerFrame is the json format of broker messages, payload is base64 encoded
+type brokerFrame struct {
+	Action  string   `json:"broker"`
+	Topics  []string `json:"topics,omitempty"`
+	Topic   string   `json:"topic,omitempty"`
+	Payload []byte   `json:"payload,omitempty"`
+}
+
+// decodeBrokerFrame returns nil if the msg is not a broker frame
+func decodeBrokerFrame(m *Message) *brokerFrame {
+	if m.Type != TextMessage {
+		return nil
+	}
+	raw, e := m.readComplete()
+	if e != nil {
+		return nil
+	}
+	// probe the action only, no matter spaces or field order
+	var probe struct {
+		Action string `json:"broker"`
+	}
+	if json.Unmarshal(raw, &probe) != nil || probe.Action == "" {
+		return nil
+	}
+	var f brokerFrame
+	if json.Unmarshal(raw, &f) != nil {
+		return nil
+	}
+	return &f
+}
+
+// SubscriberStats is the delivery stats of one subscriber
+type SubscriberStats struct {
+	Topics        []string  // subscribed topic patterns
+	Delivered     uint64    // messages dispatched successfully
+	Failed        uint64    // messages failed to dispatch
+	LastDelivered time.Time // last time a message is delivered
+}
+
+// Broker is topic based pub/sub on a pool.
+// Connections added to the broker can subscribe, unsubscribe & publish at runtime with broker messages.
+//
+// Topics are segments split by ".", "*" matches one segment and "#" as the last segment matches the rest,
+// like "orders.*" or "orders.#". The last message of every topic is retained for later subscribers.
+type Broker struct {
+	pool *Pool
+
+	lock     sync.Mutex
+	subs     map[string]map[string]struct{} // topic pattern -> connection names
+	retained map[string][]byte              // topic -> last payload
+	stats    map[string]*SubscriberStats    // connection name -> stats
+}
+
+// NewBroker creates a broker on the pool, connections should be added by Broker.Add
+func NewBroker(p *Pool) *Broker {
+	return &Broker{
+		pool:     p,
+		subs:     make(map[string]map[string]struct{}),
+		retained: make(map[string][]byte),
+		stats:    make(map[string]*SubscriberStats),
+	}
+}
+
+// Add takes the connection to the pool, and handles broker messages from it
+func (b *Broker) Add(c *Connection, config *NodeConfig) error {
+	c.Apply(b)
+	if e := b.pool.Add(c, config); e != nil {
+		c.Revoke(b.Name())
+		return e
+	}
+	return nil
+}
+
+// Subscribe the connection with the given name to topics
+func (b *Broker) Subscribe(name string, topics ...string) error {
+	for _, t := range topics {
+		if !validTopic(t, true) {
+			return errors.New("invalid topic " + t)
+		}
+	}
+	b.lock.Lock()
+	stat, ok := b.stats[name]
+	if !ok {
+		stat = &SubscriberStats{}
+		b.stats[name] = stat
+	}
+	for _, t := range topics {
+		names, ok := b.subs[t]
+		if !ok {
+			names = make(map[string]struct{})
+			b.subs[t] = names
+		}
+		if _, exist := names[name]; !exist {
+			names[name] = struct{}{}
+			stat.Topics = append(stat.Topics, t)
+		}
+	}
+	// retained messages for the new subscriptions
+	var retained []*brokerFrame
+	for topic, payload := range b.retained {
+		for _, t := range topics {
+			if matchTopic(t, topic) {
+				retained = append(retained, &brokerFrame{Action: brokerDeliver, Topic: topic, Payload: payload})
+				break
+			}
+		}
+	}
+	b.lock.Unlock()
+
+	for _, f := range retained {
+		b.deliver(name, f)
+	}
+	return nil
+}
+
+// Unsubscribe the connection with the given name from topics, all topics if none is given
+func (b *Broker) Unsubscribe(name string, topics ...string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	stat, ok := b.stats[name]
+	if !ok {
+		return
+	}
+	if len(topics) == 0 {
+		topics = stat.Topics
+	}
+	for _, t := range topics {
+		if names, ok := b.subs[t]; ok {
+			delete(names, name)
+			if len(names) == 0 {
+				delete(b.subs, t)
+			}
+		}
+	}
+	remain := stat.Topics[:0]
+	for _, st := range stat.Topics {
+		if _, ok := b.subs[st][name]; ok {
+			remain = append(remain, st)
+		}
+	}
+	stat.Topics = remain
+}
+
+// Publish the payload to subscribers of the topic, it's retained for later subscribers.
+// Topic for publishing can't contain wildcards.
+func (b *Broker) Publish(topic string, payload []byte) error {
+	if !validTopic(topic, false) {
+		return errors.New("invalid topic " + topic)
+	}
+	// payload may be reused by the caller
+	payload = append([]byte(nil), payload...)
+	b.lock.Lock()
+	b.retained[topic] = payload
+	targets := make(map[string]struct{})
+	for pattern, names := range b.subs {
+		if !matchTopic(pattern, topic) {
+			continue
+		}
+		for n := range names {
+			targets[n] = struct{}{}
+		}
+	}
+	b.lock.Unlock()
+
+	f := &brokerFrame{Action: brokerDeliver, Topic: topic, Payload: payload}
+	for name := range targets {
+		b.deliver(name, f)
+	}
+	return nil
+}
+
+// ClearRetained drops the retained message of the topic
+func (b *Broker) ClearRetained(topic string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.retained, topic)
+}
+
+// Stats of the subscriber with the given name
+func (b *Broker) Stats(name string) (SubscriberStats, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	stat, ok := b.stats[name]
+	if !ok {
+		return SubscriberStats{}, false
+	}
+	result := *stat
+	result.Topics = append([]string(nil), stat.Topics...)
+	return result, true
+}
+
+func (b *Broker) deliver(name string, f *brokerFrame) {
+	raw, _ := json.Marshal(f)
+	e := errors.New("subscriber not found")
+
+	if c, ok := b.pool.Get(name); ok {
+		e = c.Dispatch(TextMessage, raw)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	stat, ok := b.stats[name]
+	if !ok {
+		return
+	}
+	if e != nil {
+		stat.Failed += 1
+		return
+	}
+	stat.Delivered += 1
+	stat.LastDelivered = time.Now()
+}
+
+func (b *Broker) Name() string {
+	return "webson-broker-" + b.pool.name
+}
+
+func (b *Broker) OnStatus(s Status, a Adapter) {
+	if s != StatusClosed {
+		return
+	}
+	b.Unsubscribe(a.Name())
+	b.lock.Lock()
+	delete(b.stats, a.Name())
+	b.lock.Unlock()
+}
+
+func (b *Broker) OnMessage(m *Message, a Adapter) {
+	f := decodeBrokerFrame(m)
+	if f == nil {
+		return
+	}
+	switch f.Action {
+	case brokerSubscribe:
+		b.Subscribe(a.Name(), f.Topics...)
+	case brokerUnsubscribe:
+		if len(f.Topics) > 0 {
+			b.Unsubscribe(a.Name(), f.Topics...)
+		}
+	case brokerPublish:
+		b.Publish(f.Topic, f.Payload)
+	}
+}
+
+// Subscribe asks the broker on the other side to send messages of the topics
+func Subscribe(a Adapter, topics ...string) error {
+	return dispatchBrokerFrame(a, &brokerFrame{Action: brokerSubscribe, Topics: topics})
+}
+
+// Unsubscribe asks the broker on the other side to stop sending messages of the topics
+func Unsubscribe(a Adapter, topics ...string) error {
+	return dispatchBrokerFrame(a, &brokerFrame{Action: brokerUnsubscribe, Topics: topics})
+}
+
+// Publish the payload to the topic through the broker on the other side
+func Publish(a Adapter, topic string, payload []byte) error {
+	return dispatchBrokerFrame(a, &brokerFrame{Action: brokerPublish, Topic: topic, Payload: payload})
+}
+
+// OnPublished binds handler for messages delivered by the broker on the other side, later one will replace the previous one.
+// It's applied as an EventHandler, OnMessage of TextMessage is still available for other text messages.
+func OnPublished(con *Connection, action func(topic string, payload []byte, a Adapter)) {
+	h := &publishedHandler{action}
+	con.Revoke(h.Name())
+	con.Apply(h)
+}
+
+type publishedHandler struct {
+	action func(topic string, payload []byte, a Adapter)
+}
+
+func (h *publishedHandler) Name() string {
+	return "webson-published"
+}
+
+func (h *publishedHandler) OnStatus(s Status, a Adapter) {}
+
+func (h *publishedHandler) OnMessage(m *Message, a Adapter) {
+	if f := decodeBrokerFrame(m); f != nil && f.Action == brokerDeliver {
+		h.action(f.Topic, f.Payload, a)
+	}
+}
+
+func dispatchBrokerFrame(a Adapter, f *brokerFrame) error {
+	raw, e := json.Marshal(f)
+	if e != nil {
+		return e
+	}
+	return a.Dispatch(TextMessage, raw)
+}
+
+// validTopic checks empty segments & wildcards, "#" can only be the last segment
+func validTopic(topic string, wildcard bool) bool {
+	if topic == "" {
+		return false
+	}
+	segments := strings.Split(topic, ".")
+	for i, s := range segments {
+		switch s {
+		case "":
+			return false
+		case "*":
+			if !wildcard {
+				return false
+			}
+		case "#":
+			if !wildcard || i != len(segments)-1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchTopic tells whether the topic matches the pattern segment by segment
+func matchTopic(pattern, topic string) bool {
+	ps, ts := strings.Split(pattern, "."), strings.Split(topic, ".")
+	for i, p := range ps {
+		if p == "#" {
+			return len(ts) > i
+		}
+		if i >= len(ts) || p != "*" && p != ts[i] {
+			return false
+		}
+	}
+	return len(ps) == len(ts)
+}
@@ -0,0 +1,164 @@
+package webson
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	for _, c := range []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "orders.new", false},
+		{"orders.*", "orders.new", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.new.paid", false},
+		{"*.new", "orders.new", true},
+		{"orders.#", "orders.new.paid", true},
+		{"orders.#", "orders", false},
+		{"#", "orders", true},
+	} {
+		if matchTopic(c.pattern, c.topic) != c.match {
+			t.Errorf("unexpected match for %s & %s", c.pattern, c.topic)
+		}
+	}
+	for _, topic := range []string{"", "a..b", "a.#.b"} {
+		if validTopic(topic, true) {
+			t.Errorf("topic %q should be invalid", topic)
+		}
+	}
+	if validTopic("a.*", false) {
+		t.Error("wildcard should be invalid for publishing")
+	}
+}
+
+func TestBroker(t *testing.T) {
+	broker := NewBroker(NewPool(nil))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, nil)
+		if e != nil {
+			return
+		}
+		broker.Add(ws, &NodeConfig{Name: r.URL.Query().Get("name")})
+	}))
+	defer s.Close()
+
+	type delivery struct {
+		topic, payload string
+	}
+	subscriber := func(name string, topics ...string) (*Connection, chan delivery) {
+		ws, e := Dial(s.URL+"/?name="+name, nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+		received := make(chan delivery, 10)
+		OnPublished(ws, func(topic string, payload []byte, a Adapter) {
+			received <- delivery{topic, string(payload)}
+		})
+		ws.OnReady(func(a Adapter) {
+			Subscribe(a, topics...)
+		})
+		go ws.Start()
+		time.Sleep(20 * time.Millisecond)
+		return ws, received
+	}
+	expect := func(ch chan delivery, d delivery) {
+		select {
+		case got := <-ch:
+			if got != d {
+				t.Errorf("unexpected delivery %v", got)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v not delivered", d)
+		}
+	}
+
+	first, firstReceived := subscriber("first", "orders.*")
+	defer first.Close()
+	Publish(first, "orders.new", []byte("1"))
+	expect(firstReceived, delivery{"orders.new", "1"})
+
+	// retained message for later subscriber
+	second, secondReceived := subscriber("second", "orders.#", "users")
+	defer second.Close()
+	expect(secondReceived, delivery{"orders.new", "1"})
+
+	broker.Publish("users", []byte("2"))
+	expect(secondReceived, delivery{"users", "2"})
+
+	Unsubscribe(second, "orders.#")
+	time.Sleep(20 * time.Millisecond)
+	broker.Publish("orders.paid", []byte("3"))
+	expect(firstReceived, delivery{"orders.paid", "3"})
+	select {
+	case d := <-secondReceived:
+		t.Errorf("unexpected delivery after unsubscribe %v", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stats, ok := broker.Stats("second")
+	if !ok || stats.Delivered != 2 || len(stats.Topics) != 1 || stats.Topics[0] != "users" {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats, _ := broker.Stats("first"); stats.Delivered != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// retained payload is kept even if the caller reuses it
+	payload := []byte("4")
+	broker.Publish("news", payload)
+	payload[0] = 'x'
+
+	// browsers talk to the broker with json text only
+	browser, e := Dial(s.URL+"/?name=browser", nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer browser.Close()
+	texts := make(chan string, 2)
+	browser.OnMessage(TextMessage, func(m *Message, a Adapter) {
+		raw, _ := m.Read()
+		texts <- string(raw)
+	})
+	browser.OnReady(func(a Adapter) {
+		a.Dispatch(TextMessage, []byte(`{ "topics": ["news"], "broker": "subscribe" }`))
+	})
+	go browser.Start()
+	select {
+	case text := <-texts:
+		if text != `{"broker":"message","topic":"news","payload":"NA=="}` {
+			t.Errorf("unexpected delivery %s", text)
+		}
+	case <-time.After(time.Second):
+		t.Error("retained message not delivered")
+	}
+}
+
+func TestDecodeBrokerFrame(t *testing.T) {
+	for raw, action := range map[string]string{
+		`{"broker":"subscribe","topics":["a"]}`:      brokerSubscribe,
+		`{"topics": ["a"], "broker": "unsubscribe"}`: brokerUnsubscribe,
+		"\n{ \"broker\" : \"publish\" }":             brokerPublish,
+		`{"broker":""}`:                              "",
+		`{"type":"point","data":{"broker":"x"}}`:     "",
+		`{"broker":`:                                 "",
+		`plain`:                                      "",
+	} {
+		m := &Message{Type: TextMessage, config: &msgConfig{}, receive: &msgReceivedStatus{}}
+		m.entity.WriteString(raw)
+		f := decodeBrokerFrame(m)
+		if action == "" {
+			if f != nil {
+				t.Errorf("%s is taken as broker frame", raw)
+			}
+			continue
+		}
+		if f == nil || f.Action != action {
+			t.Errorf("unexpected frame of %s: %+v", raw, f)
+		}
+	}
+}
@@ -2,10 +2,12 @@ package webson
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
@@ -30,7 +32,14 @@ func (s *simpleUrl) formatRequestBase() string {
 	return requestLine
 }
 
+// Dial connects to the websocket server at addr and negotiates the upgrade.
 func Dial(addr string, c *DialConfig) (*Connection, error) {
+	return DialContext(context.Background(), addr, c)
+}
+
+// DialContext is Dial with a context, the tcp/tls dial, upgrade request writing
+// and response reading will be aborted once ctx is done, a *DialError will be returned.
+func DialContext(ctx context.Context, addr string, c *DialConfig) (*Connection, error) {
 	p := parseUrl(addr)
 	if p == nil {
 		panic("address is invalid")
@@ -40,14 +49,36 @@ func Dial(addr string, c *DialConfig) (*Connection, error) {
 	}
 	c.url = p
 	c.UseTLS = p.useTLS || c.UseTLS || c.TLSConfig != nil
-	if c.UseTLS {
-		c.dialer = func() (net.Conn, error) {
-			return tls.Dial("tcp", c.url.hostPort, c.TLSConfig)
+	c.dialer = func(ctx context.Context) (net.Conn, error) {
+		var raw net.Conn
+		var e error
+		if c.NetDial != nil {
+			raw, e = c.NetDial(ctx, c.url.hostPort)
+			if _, secured := raw.(*tls.Conn); secured {
+				// an established TLS session is used as it is
+				return raw, e
+			}
+		} else {
+			raw, e = c.dialTCP(ctx, time.Duration(c.Timeout.HandshakeTimeout)*time.Second)
 		}
-	} else {
-		c.dialer = func() (net.Conn, error) {
-			return net.Dial("tcp", c.url.hostPort)
+		if e != nil || !c.UseTLS {
+			return raw, e
+		}
+		// TLS is layered after proxy tunnel or custom connection is created
+		tlsConfig := c.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(c.url.hostPort)
 		}
+		tlsRaw := tls.Client(raw, tlsConfig)
+		if e := tlsRaw.HandshakeContext(ctx); e != nil {
+			raw.Close()
+			return nil, e
+		}
+		return tlsRaw, nil
 	}
 	con := &Connection{
 		config:   &c.Config,
@@ -57,25 +88,61 @@ func Dial(addr string, c *DialConfig) (*Connection, error) {
 	if e := con.config.setup(); e != nil {
 		return nil, e
 	}
-	if raw, negoConfig, e := negotiate(con.client, con.config); e != nil {
+	if c.Reconnect != nil {
+		c.Reconnect.setup()
+		if c.Reconnect.BufferSize > 0 && c.SendQueue == nil {
+			c.SendQueue = &SendQueue{Size: c.Reconnect.BufferSize}
+		}
+	}
+	if raw, negoConfig, e := negotiate(ctx, con.client, con.config); e != nil {
 		return nil, e
 	} else {
 		con.rawConnection = raw
 		con.negoSet = *negoConfig
 	}
-	con.prepare()
+	if e := con.prepare(); e != nil {
+		con.rawConnection.Close()
+		return nil, e
+	}
 	return con, nil
 }
 
-func negotiate(client *ClientConfig, config *Config) (con net.Conn, nego *negoSet, e error) {
+// watchContext aborts blocking write & read of raw once ctx is done, stop waits for the watcher to quit
+func watchContext(ctx context.Context, raw net.Conn) (stop func()) {
+	stopWatch := make(chan struct{})
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		select {
+		case <-ctx.Done():
+			raw.SetDeadline(time.Now())
+		case <-stopWatch:
+		}
+	}()
+	return func() {
+		close(stopWatch)
+		<-watchDone
+	}
+}
+
+func negotiate(ctx context.Context, client *ClientConfig, config *Config) (con net.Conn, nego *negoSet, e error) {
 
-	raw, e := client.dialer()
+	raw, e := client.dialer(ctx)
 	if e != nil {
-		return
+		return nil, nil, &DialError{PhaseDial, e}
+	}
+	if config.Timeout.HandshakeTimeout > 0 {
+		raw.SetDeadline(time.Now().Add(time.Duration(config.Timeout.HandshakeTimeout) * time.Second))
 	}
+	stopWatch := watchContext(ctx, raw)
+	phase := PhaseWriteRequest
 	defer func() {
+		stopWatch()
 		if con == nil {
 			raw.Close()
+			if ctx.Err() != nil {
+				e = &DialError{phase, ctx.Err()}
+			}
 		}
 	}()
 	challengeKey := createChallengeKey()
@@ -92,62 +159,62 @@ func negotiate(client *ClientConfig, config *Config) (con net.Conn, nego *negoSe
 			headers[k] = v
 		}
 	}
+	if client.HeaderRefresh != nil {
+		for k, v := range client.HeaderRefresh() {
+			headers[k] = v
+		}
+	}
+	var deflateOffer *deflateParams
 	if config.EnableCompress {
-		headers["Sec-Websocket-Extensions"] = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+		deflateOffer = config.offerDeflate()
+		headers["Sec-Websocket-Extensions"] = deflateOffer.String()
+	}
+	if len(config.Subprotocols) > 0 {
+		headers["Sec-Websocket-Protocol"] = strings.Join(config.Subprotocols, ", ")
 	}
 	if config.EnableStreams {
 		headers["Webson-Max-Streams"] = strconv.Itoa(config.MaxStreams)
+		if config.StreamWindow > 0 {
+			headers["Webson-Stream-Window"] = strconv.Itoa(config.StreamWindow)
+		}
+	}
+	if config.EnableRPC {
+		headers["Webson-Rpc"] = "1"
+	}
+	if config.EnableCluster {
+		headers["Webson-Cluster"] = "1"
 	}
 	for k, v := range headers {
 		request += k + ":" + v + "\r\n"
 	}
 	_, e = raw.Write([]byte(request + "\r\n"))
 	if e != nil {
-		return
-	}
-	if config.Timeout.HandshakeTimeout > 0 {
-		raw.SetReadDeadline(time.Now().Add(time.Duration(config.Timeout.HandshakeTimeout) * time.Second))
+		return nil, nil, &DialError{phase, e}
 	}
+	phase = PhaseReadResponse
 
 	tmp := bufio.NewReader(raw)
-	responsed := false
-	verify := make(http.Header)
-	malformedResponse := errors.New("malformed response")
-	for {
-		row, tooLong, e := tmp.ReadLine()
-		if tooLong {
-			return nil, nil, malformedResponse
-		}
-		if e != nil {
-			// EOF means connection is break
-			return nil, nil, e
-		}
-		left := string(row)
-		if left == "" {
-			break
-		}
-		if !responsed {
-			responsed = true
-			if i := strings.Index(left, " "); i > 0 {
-				left = left[i+1:]
-			} else {
-				return nil, nil, malformedResponse
-			}
-			if i := strings.Index(left, " "); i > 0 {
-				code := left[:i]
-				reason := left[i+1:]
-				if code != "101" || reason != "Switching Protocols" {
-					return nil, nil, errors.New("ws not supported")
-				}
-			}
-		} else {
-			if i := strings.Index(left, ":"); i > 0 {
-				key := strings.Title(strings.ToLower(left[:i]))
-				v := strings.Trim(left[i+1:], " ")
-				verify.Add(key, v)
-			}
+	resp, e := http.ReadResponse(tmp, &http.Request{Method: http.MethodGet})
+	if e != nil {
+		// EOF means connection is break
+		return nil, nil, &DialError{phase, e}
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// reason phrase is not reliable, only status code matters
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, handshakeBodyLimit))
+		resp.Body.Close()
+		return nil, nil, &HandshakeError{
+			StatusCode: resp.StatusCode,
+			Reason:     strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+			Header:     resp.Header,
+			Body:       body,
 		}
 	}
+	verify := resp.Header
+	if tmp.Buffered() > 0 {
+		// frames may come along with the response
+		raw = &bufferedConn{raw, tmp}
+	}
 
 	if config.HeaderVerify != nil && !config.HeaderVerify(verify) {
 		return nil, nil, errors.New("header verify not passed")
@@ -159,15 +226,23 @@ func negotiate(client *ClientConfig, config *Config) (con net.Conn, nego *negoSe
 		return
 	}
 	nego = &negoSet{}
-	if config.EnableCompress &&
-		verify.Get("Sec-Websocket-Extensions") == "permessage-deflate; server_no_context_takeover; client_no_context_takeover" {
-		nego.compressable = true
-		nego.compressLevel = config.CompressLevel
-		if nego.compressLevel == 0 {
-			nego.compressLevel = DEFAULT_COMPRESS_LEVEL
+	if subprotocol := verify.Get("Sec-Websocket-Protocol"); subprotocol != "" {
+		offered := false
+		for _, p := range config.Subprotocols {
+			if p == subprotocol {
+				offered = true
+				break
+			}
 		}
+		if !offered {
+			return nil, nil, fmt.Errorf("subprotocol %s is not offered", subprotocol)
+		}
+		nego.subprotocol = subprotocol
 	}
 
+	nego.rpc = config.EnableRPC && verify.Get("Webson-Rpc") == "1"
+	nego.cluster = config.EnableCluster && verify.Get("Webson-Cluster") == "1"
+
 	serverStreams := verify.Get("Webson-Max-Streams")
 	if config.EnableStreams && serverStreams != "" {
 		serverWant, e := strconv.Atoi(serverStreams)
@@ -180,6 +255,26 @@ func negotiate(client *ClientConfig, config *Config) (con net.Conn, nego *negoSe
 			if serverWant < nego.maxStreams {
 				nego.maxStreams = serverWant
 			}
+			if serverWindow, e := strconv.Atoi(verify.Get("Webson-Stream-Window")); e == nil && serverWindow > 0 && config.StreamWindow > 0 {
+				nego.sendWindow = serverWindow
+				nego.recvWindow = config.StreamWindow
+			}
+		}
+	}
+
+	if extensions := verify.Values("Sec-Websocket-Extensions"); len(extensions) > 0 {
+		resps, errs := parseDeflateParams(extensions)
+		if len(resps) > 1 || deflateOffer == nil && len(resps) > 0 {
+			return nil, nil, errors.New("unexpected extension response")
+		}
+		if len(resps) == 1 {
+			if errs[0] != nil {
+				return nil, nil, errs[0]
+			}
+			if e := deflateOffer.verifyDeflate(resps[0]); e != nil {
+				return nil, nil, e
+			}
+			nego.deflateSet(resps[0], config.CompressLevel, true)
 		}
 	}
 	return raw, nego, nil
@@ -0,0 +1,232 @@
+package webson
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDialContextCancel(t *testing.T) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	go func() {
+		// accept but never respond
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, e = DialContext(ctx, l.Addr().String(), nil)
+	if time.Since(start) > 2*time.Second {
+		t.Error("dial is not aborted in time")
+	}
+	var de *DialError
+	if !errors.As(e, &de) {
+		t.Fatalf("unexpected error %v", e)
+	}
+	if de.Phase != PhaseReadResponse || !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("unexpected dial error %v", e)
+	}
+}
+
+// newEchoServer starts a websocket server echoing every text message
+func newEchoServer(t *testing.T, c *Config) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, c)
+		if e != nil {
+			return
+		}
+		ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+			msg, _ := m.Read()
+			a.Dispatch(TextMessage, msg)
+		})
+		ws.Start()
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// echoOnce dials addr, sends a text message and waits for the echo
+func echoOnce(t *testing.T, addr string, c *DialConfig) {
+	ws, e := Dial(addr, c)
+	if e != nil {
+		t.Fatal(e)
+	}
+	received := make(chan []byte, 1)
+	ws.OnReady(func(a Adapter) {
+		a.Dispatch(TextMessage, []byte("hello"))
+	})
+	ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+		msg, _ := m.Read()
+		received <- msg
+		a.Close()
+	})
+	go ws.Start()
+	select {
+	case msg := <-received:
+		if string(msg) != "hello" {
+			t.Errorf("unexpected echo %q", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("echo timeout")
+	}
+}
+
+func TestNetDial(t *testing.T) {
+	s := newEchoServer(t, nil)
+	dialed := 0
+	echoOnce(t, "ws://webson.local/", &DialConfig{
+		ClientConfig: ClientConfig{
+			NetDial: func(ctx context.Context, addr string) (net.Conn, error) {
+				if addr != "webson.local:80" {
+					t.Errorf("unexpected addr %s", addr)
+				}
+				dialed += 1
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", s.Listener.Addr().String())
+			},
+		},
+	})
+	if dialed != 1 {
+		t.Errorf("NetDial is called %d times", dialed)
+	}
+}
+
+func TestNetDialTLS(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, nil)
+		if e != nil {
+			return
+		}
+		ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+			msg, _ := m.Read()
+			a.Dispatch(TextMessage, msg)
+		})
+		ws.Start()
+	}))
+	s.StartTLS()
+	defer s.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	tlsConfig := &tls.Config{RootCAs: roots}
+
+	// TLS is layered on plain connections for wss
+	echoOnce(t, "wss://example.com/", &DialConfig{
+		ClientConfig: ClientConfig{
+			TLSConfig: tlsConfig,
+			NetDial: func(ctx context.Context, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", s.Listener.Addr().String())
+			},
+		},
+	})
+	// established TLS session is used as it is
+	echoOnce(t, "wss://example.com/", &DialConfig{
+		ClientConfig: ClientConfig{
+			NetDial: func(ctx context.Context, addr string) (net.Conn, error) {
+				d := tls.Dialer{Config: &tls.Config{RootCAs: roots, ServerName: "example.com"}}
+				return d.DialContext(ctx, "tcp", s.Listener.Addr().String())
+			},
+		},
+	})
+}
+
+func TestSubprotocol(t *testing.T) {
+	s := newEchoServer(t, &Config{Subprotocols: []string{"v2.msgpack", "v1.json"}})
+	ws, e := Dial(s.URL, &DialConfig{Config: Config{Subprotocols: []string{"v1.json", "v2.msgpack"}}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ws.rawConnection.Close()
+	if ws.Subprotocol() != "v1.json" {
+		t.Errorf("unexpected subprotocol %q", ws.Subprotocol())
+	}
+
+	ws, e = Dial(s.URL, &DialConfig{Config: Config{Subprotocols: []string{"v3"}}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ws.rawConnection.Close()
+	if ws.Subprotocol() != "" {
+		t.Errorf("unexpected subprotocol %q", ws.Subprotocol())
+	}
+}
+
+func TestHandshakeError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+	}))
+	defer s.Close()
+
+	_, e := Dial(s.URL, nil)
+	var he *HandshakeError
+	if !errors.As(e, &he) {
+		t.Fatalf("unexpected error %v", e)
+	}
+	if he.StatusCode != http.StatusTooManyRequests || he.Reason != "Too Many Requests" ||
+		he.RetryAfter() != 3*time.Second || string(he.Body) != "too many connections\n" {
+		t.Errorf("unexpected handshake error %+v", he)
+	}
+}
+
+func TestSwitchingReason(t *testing.T) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	go func() {
+		c, e := l.Accept()
+		if e != nil {
+			return
+		}
+		defer c.Close()
+		r, e := http.ReadRequest(bufio.NewReader(c))
+		if e != nil {
+			return
+		}
+		c.Write([]byte("HTTP/1.1 101 OK\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+			magicDigest(r.Header.Get("Sec-Websocket-Key"), nil) + "\r\n\r\n"))
+		// frame sent along with the response
+		c.Write([]byte{0b1000_0001, 5, 'h', 'e', 'l', 'l', 'o'})
+		time.Sleep(time.Second)
+	}()
+
+	ws, e := Dial(l.Addr().String(), nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	received := make(chan []byte, 1)
+	ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+		msg, _ := m.Read()
+		received <- msg
+	})
+	go ws.Start()
+	defer ws.rawConnection.Close()
+	select {
+	case msg := <-received:
+		if string(msg) != "hello" {
+			t.Errorf("unexpected msg %q", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("msg along with response is lost")
+	}
+}
@@ -0,0 +1,498 @@
+package webson
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClusterMessage is the private data type for node to node messages.
+//
+// Opcode 0x5 is reserved for further data frames by RFC6455, other implementations will fail the connection with it.
+// It's only tolerable because it's sent after both sides negotiated cluster in the handshake with Config.EnableCluster,
+// so the other side is known to be webson.
+const ClusterMessage = MessageType(5)
+
+const (
+	clusterHello    = "hello"
+	clusterOwn      = "own"
+	clusterDisown   = "disown"
+	clusterDispatch = "dispatch"
+	clusterGroup    = "group"
+	clusterPick     = "pick"
+	clusterExcept   = "except"
+)
+
+// clusterFrame is the json format of cluster messages
+type clusterFrame struct {
+	ID     string `json:"id,omitempty"`
+	Origin string `json:"origin"`
+	Kind   string `json:"kind"`
+
+	Target  string      `json:"target,omitempty"` // group or connection name
+	Type    MessageType `json:"type,omitempty"`
+	Payload []byte      `json:"payload,omitempty"`
+
+	Names []string `json:"names,omitempty"` // connection names owned by Origin
+}
+
+// ClusterConfig is for creating a cluster pool
+type ClusterConfig struct {
+	NodeID string // unique id of this node, will be a random string if empty
+
+	Peers            []string        // static peer addresses, like ws://10.0.0.2:8000/peer
+	Discover         func() []string // peer addresses discovery, called every DiscoverInterval
+	DiscoverInterval time.Duration   // interval for discovery & reconnecting lost peers
+
+	// DialPeer replaces the default peer dialing with Dial(addr, PeerConfig).
+	// The returned connection should not start yet, and it should be dialed with Config.EnableCluster.
+	DialPeer   func(ctx context.Context, addr string) (*Connection, error)
+	PeerConfig *DialConfig // dial config for peers
+
+	DedupSize int // how many recent message ids are kept for deduplication
+}
+
+// ClusterPool is a Pool whose broadcasts are forwarded to peer nodes over webson connections.
+// Messages are flooded to all peers with ids for deduplication, so nodes can be connected in mesh or star.
+// Don't create one just use &ClusterPool{xxx}, use NewClusterPool instead.
+type ClusterPool struct {
+	*Pool
+
+	config *ClusterConfig
+	peers  *Pool // node to node connections
+
+	lock     sync.Mutex
+	lastId   uint64
+	links    map[string]*Connection // node id -> connection
+	linkNode map[*Connection]string // connection -> node id
+	dialed   map[string]*Connection // peer address -> connection
+	owners   map[string]string      // connection name -> node id
+	seen     map[string]struct{}
+	seenList []string
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewClusterPool create a usable cluster pool, call Start to connect peers
+func NewClusterPool(p *PoolConfig, c *ClusterConfig) *ClusterPool {
+	if c == nil {
+		c = &ClusterConfig{}
+	}
+	if c.NodeID == "" {
+		c.NodeID = createChallengeKey()
+	}
+	if c.DiscoverInterval <= 0 {
+		c.DiscoverInterval = DEFAULT_DISCOVER_INTERVAL
+	}
+	if c.DedupSize <= 0 {
+		c.DedupSize = DEFAULT_DEDUP_SIZE
+	}
+	cp := &ClusterPool{
+		Pool:   NewPool(p),
+		config: c,
+		peers:  NewPool(&PoolConfig{Name: "webson-cluster-" + c.NodeID}),
+
+		links:    make(map[string]*Connection),
+		linkNode: make(map[*Connection]string),
+		dialed:   make(map[string]*Connection),
+		owners:   make(map[string]string),
+		seen:     make(map[string]struct{}),
+		stop:     make(chan struct{}),
+	}
+	cp.Pool.removed = func(c *Connection) {
+		cp.flood(&clusterFrame{Kind: clusterDisown, Names: []string{c.node.Name}}, nil)
+	}
+	cp.peers.removed = cp.unlink
+	cp.peers.OnStatus(func(s Status, a Adapter) {
+		if s != StatusReady {
+			return
+		}
+		if con, ok := a.(*Connection); ok && !con.negoSet.cluster {
+			// the other side is not a webson cluster node
+			con.CloseWithCode(&CloseCode{PolicyViolation, "cluster not negotiated"})
+			return
+		}
+		a.Dispatch(ClusterMessage, cp.hello())
+	})
+	cp.peers.OnMessage(cp.onPeerMessage)
+	return cp
+}
+
+// NodeID of this node
+func (cp *ClusterPool) NodeID() string {
+	return cp.config.NodeID
+}
+
+// Start connecting static & discovered peers, lost peers will be reconnected every DiscoverInterval
+func (cp *ClusterPool) Start() {
+	cp.connectPeers()
+	go func() {
+		ticker := time.NewTicker(cp.config.DiscoverInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cp.connectPeers()
+			case <-cp.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (cp *ClusterPool) connectPeers() {
+	addrs := append([]string(nil), cp.config.Peers...)
+	if cp.config.Discover != nil {
+		addrs = append(addrs, cp.config.Discover()...)
+	}
+	for _, addr := range addrs {
+		cp.lock.Lock()
+		_, connected := cp.dialed[addr]
+		cp.lock.Unlock()
+		if connected {
+			continue
+		}
+		con, e := cp.dialPeer(addr)
+		if e != nil {
+			continue
+		}
+		cp.lock.Lock()
+		cp.dialed[addr] = con
+		cp.lock.Unlock()
+		if cp.peers.Add(con, nil) != nil {
+			con.Close()
+			cp.lock.Lock()
+			delete(cp.dialed, addr)
+			cp.lock.Unlock()
+		}
+	}
+}
+
+func (cp *ClusterPool) dialPeer(addr string) (*Connection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cp.config.DiscoverInterval)
+	defer cancel()
+	if cp.config.DialPeer != nil {
+		return cp.config.DialPeer(ctx, addr)
+	}
+	// config is modified when dialing, don't share it between peers
+	config := &DialConfig{}
+	if cp.config.PeerConfig != nil {
+		*config = *cp.config.PeerConfig
+	}
+	config.EnableCluster = true
+	return DialContext(ctx, addr, config)
+}
+
+// TakeOverPeer upgrades the request from a peer node, the connection is managed by the cluster pool.
+// Config.EnableCluster is set on a copy of c.
+func (cp *ClusterPool) TakeOverPeer(w http.ResponseWriter, r *http.Request, c *Config) error {
+	config := &Config{}
+	if c != nil {
+		*config = *c
+	}
+	config.EnableCluster = true
+	con, e := TakeOver(w, r, config)
+	if e != nil {
+		return e
+	}
+	if e := cp.peers.Add(con, nil); e != nil {
+		con.Close()
+		return e
+	}
+	return nil
+}
+
+// Peers are node ids of connected peers
+func (cp *ClusterPool) Peers() []string {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	var ids []string
+	for id := range cp.links {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Owner tells which node owns the connection with the given name
+func (cp *ClusterPool) Owner(name string) (string, bool) {
+	if _, local := cp.Pool.Get(name); local {
+		return cp.config.NodeID, true
+	}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	id, ok := cp.owners[name]
+	return id, ok
+}
+
+// Add takes one connection to the local pool, peers will know this node owns it
+func (cp *ClusterPool) Add(c *Connection, config *NodeConfig) error {
+	if e := cp.Pool.Add(c, config); e != nil {
+		return e
+	}
+	cp.flood(&clusterFrame{Kind: clusterOwn, Names: []string{c.node.Name}}, nil)
+	return nil
+}
+
+// Dispatch will broadcast the message to all connections in the cluster, report is for local connections only
+func (cp *ClusterPool) Dispatch(t MessageType, payload []byte) *DeliveryReport {
+	report := cp.Pool.Dispatch(t, payload)
+	cp.flood(&clusterFrame{Kind: clusterDispatch, Type: t, Payload: payload}, nil)
+	return report
+}
+
+// ToGroup will broadcast the message to the given group connections in the cluster
+func (cp *ClusterPool) ToGroup(gName string, t MessageType, payload []byte) *DeliveryReport {
+	report := cp.Pool.ToGroup(gName, t, payload)
+	cp.flood(&clusterFrame{Kind: clusterGroup, Target: gName, Type: t, Payload: payload}, nil)
+	return report
+}
+
+// ToPick will try to send message to the connection with given name in the cluster.
+// For connection owned by other node, Accepted means it's forwarded to the owner.
+func (cp *ClusterPool) ToPick(name string, t MessageType, payload []byte) *DeliveryReport {
+	if report := cp.Pool.ToPick(name, t, payload); pickedLocal(report, name) {
+		return report
+	}
+	report := newDeliveryReport()
+	f := &clusterFrame{Kind: clusterPick, Target: name, Type: t, Payload: payload}
+	cp.lock.Lock()
+	owner, ok := cp.owners[name]
+	link := cp.links[owner]
+	if ok && link != nil {
+		f.ID = cp.nextId()
+	}
+	cp.lock.Unlock()
+	if !ok {
+		report.Failed = append(report.Failed, name)
+		report.fail(name, NodeNotFound{name})
+		return report
+	}
+	if link != nil {
+		// owner is connected directly
+		if e := link.Dispatch(ClusterMessage, cp.encode(f)); e != nil {
+			report.Failed = append(report.Failed, name)
+			report.fail(name, e)
+			return report
+		}
+	} else {
+		cp.flood(f, nil)
+	}
+	report.Accepted = append(report.Accepted, name)
+	return report
+}
+
+// pickedLocal tells whether the connection is found in local pool
+func pickedLocal(report *DeliveryReport, name string) bool {
+	_, notFound := report.Failures()[name].(NodeNotFound)
+	return !notFound
+}
+
+// Except will broadcast message to all connections in the cluster except the given name
+func (cp *ClusterPool) Except(name string, t MessageType, payload []byte) *DeliveryReport {
+	report := cp.Pool.Except(name, t, payload)
+	cp.flood(&clusterFrame{Kind: clusterExcept, Target: name, Type: t, Payload: payload}, nil)
+	return report
+}
+
+// Close the local pool & links to peers, return when all connection closed
+func (cp *ClusterPool) Close() {
+	cp.Shutdown(context.Background())
+}
+
+// Shutdown stops discovery, shuts down links to peers & the local pool
+func (cp *ClusterPool) Shutdown(ctx context.Context) error {
+	cp.stopOnce.Do(func() {
+		close(cp.stop)
+	})
+	peerDone := make(chan error, 1)
+	go func() {
+		peerDone <- cp.peers.Shutdown(ctx)
+	}()
+	e := cp.Pool.Shutdown(ctx)
+	if ep := <-peerDone; e == nil {
+		e = ep
+	}
+	return e
+}
+
+func (cp *ClusterPool) hello() []byte {
+	return cp.encode(&clusterFrame{Kind: clusterHello, Names: cp.Pool.Names()})
+}
+
+func (cp *ClusterPool) encode(f *clusterFrame) []byte {
+	if f.Origin == "" {
+		f.Origin = cp.config.NodeID
+	}
+	raw, _ := json.Marshal(f)
+	return raw
+}
+
+// flood sends the frame to all linked peers except from, id is assigned for frames from this node
+func (cp *ClusterPool) flood(f *clusterFrame, from *Connection) {
+	cp.lock.Lock()
+	if f.ID == "" {
+		f.ID = cp.nextId()
+	}
+	targets := make([]*Connection, 0, len(cp.links))
+	for id, link := range cp.links {
+		if link == from || id == f.Origin {
+			continue
+		}
+		targets = append(targets, link)
+	}
+	cp.lock.Unlock()
+
+	raw := cp.encode(f)
+	for _, link := range targets {
+		link.Dispatch(ClusterMessage, raw)
+	}
+}
+
+// nextId creates message id for this node, lock should be held
+func (cp *ClusterPool) nextId() string {
+	cp.lastId += 1
+	id := cp.config.NodeID + "-" + strconv.FormatUint(cp.lastId, 10)
+	cp.markSeen(id)
+	return id
+}
+
+// markSeen returns false if the id is seen already, lock should be held
+func (cp *ClusterPool) markSeen(id string) bool {
+	if _, ok := cp.seen[id]; ok {
+		return false
+	}
+	cp.seen[id] = struct{}{}
+	cp.seenList = append(cp.seenList, id)
+	if len(cp.seenList) > cp.config.DedupSize {
+		delete(cp.seen, cp.seenList[0])
+		cp.seenList = cp.seenList[1:]
+	}
+	return true
+}
+
+func (cp *ClusterPool) unlink(c *Connection) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	for addr, con := range cp.dialed {
+		if con == c {
+			delete(cp.dialed, addr)
+		}
+	}
+	id, ok := cp.linkNode[c]
+	if !ok {
+		return
+	}
+	delete(cp.linkNode, c)
+	if cp.links[id] != c {
+		return
+	}
+	delete(cp.links, id)
+	// another link to the same node takes over
+	for con, node := range cp.linkNode {
+		if node == id {
+			cp.links[id] = con
+			return
+		}
+	}
+	for name, owner := range cp.owners {
+		if owner == id {
+			delete(cp.owners, name)
+		}
+	}
+}
+
+func (cp *ClusterPool) onPeerMessage(m *Message, a Adapter) {
+	if m.Type != ClusterMessage || m.config.negotiate == nil || !m.config.negotiate.cluster {
+		return
+	}
+	raw, e := m.readComplete()
+	if e != nil {
+		return
+	}
+	var f clusterFrame
+	if json.Unmarshal(raw, &f) != nil {
+		return
+	}
+	con, ok := a.(*Connection)
+	if !ok {
+		return
+	}
+	if f.Kind == clusterHello {
+		cp.link(con, &f)
+		return
+	}
+	if f.Origin == cp.config.NodeID {
+		return
+	}
+	cp.lock.Lock()
+	fresh := cp.markSeen(f.ID)
+	cp.lock.Unlock()
+	if !fresh {
+		return
+	}
+
+	switch f.Kind {
+	case clusterOwn, clusterDisown:
+		cp.lock.Lock()
+		for _, n := range f.Names {
+			if f.Kind == clusterOwn {
+				cp.owners[n] = f.Origin
+			} else if cp.owners[n] == f.Origin {
+				delete(cp.owners, n)
+			}
+		}
+		cp.lock.Unlock()
+	case clusterDispatch:
+		cp.Pool.Dispatch(f.Type, f.Payload)
+	case clusterGroup:
+		cp.Pool.ToGroup(f.Target, f.Type, f.Payload)
+	case clusterExcept:
+		cp.Pool.Except(f.Target, f.Type, f.Payload)
+	case clusterPick:
+		if pickedLocal(cp.Pool.ToPick(f.Target, f.Type, f.Payload), f.Target) {
+			// delivered, no need to forward
+			return
+		}
+	default:
+		return
+	}
+	cp.flood(&f, con)
+}
+
+func (cp *ClusterPool) link(con *Connection, f *clusterFrame) {
+	if f.Origin == cp.config.NodeID {
+		// connected to this node itself
+		con.Close()
+		return
+	}
+	cp.lock.Lock()
+	cp.linkNode[con] = f.Origin
+	if _, ok := cp.links[f.Origin]; !ok {
+		cp.links[f.Origin] = con
+	}
+	for _, n := range f.Names {
+		cp.owners[n] = f.Origin
+	}
+	// tell the new peer about connections owned by other nodes
+	known := make(map[string][]string)
+	for n, owner := range cp.owners {
+		if owner != f.Origin {
+			known[owner] = append(known[owner], n)
+		}
+	}
+	cp.lock.Unlock()
+
+	for owner, names := range known {
+		cp.lock.Lock()
+		id := cp.nextId()
+		cp.lock.Unlock()
+		con.Dispatch(ClusterMessage, cp.encode(&clusterFrame{ID: id, Origin: owner, Kind: clusterOwn, Names: names}))
+	}
+	// and other peers about connections owned by the new peer
+	if len(f.Names) > 0 {
+		cp.flood(&clusterFrame{Origin: f.Origin, Kind: clusterOwn, Names: f.Names}, con)
+	}
+}
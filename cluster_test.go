@@ -0,0 +1,176 @@
+package webson
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newClusterNode serves peers on /peer and clients on /client?name=xxx&groups=xxx
+func newClusterNode(t *testing.T, c *ClusterConfig) (*ClusterPool, string) {
+	cp := NewClusterPool(nil, c)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/peer" {
+			cp.TakeOverPeer(w, r, nil)
+			return
+		}
+		ws, e := TakeOver(w, r, nil)
+		if e != nil {
+			return
+		}
+		node := &NodeConfig{Name: r.URL.Query().Get("name"), Group: r.URL.Query().Get("group")}
+		if e := cp.Add(ws, node); e != nil {
+			t.Error(e)
+		}
+	}))
+	t.Cleanup(s.Close)
+	cp.Start()
+	return cp, s.URL
+}
+
+func TestClusterPool(t *testing.T) {
+	a, aURL := newClusterNode(t, &ClusterConfig{NodeID: "a"})
+	b, bURL := newClusterNode(t, &ClusterConfig{NodeID: "b", Peers: []string{aURL + "/peer"}})
+	// c links to both a & b, messages will come by two paths
+	c, _ := newClusterNode(t, &ClusterConfig{NodeID: "c", Peers: []string{aURL + "/peer", bURL + "/peer"}})
+	time.Sleep(50 * time.Millisecond)
+	if len(a.Peers()) != 2 || len(b.Peers()) != 2 || len(c.Peers()) != 2 {
+		t.Fatalf("unexpected peers %v %v %v", a.Peers(), b.Peers(), c.Peers())
+	}
+
+	_, a1 := dialReceiver(t, aURL+"/client?name=a1&group=g1")
+	_, b1 := dialReceiver(t, bURL+"/client?name=b1&group=g1")
+	_, b2 := dialReceiver(t, bURL+"/client?name=b2")
+	time.Sleep(50 * time.Millisecond)
+
+	expect := func(ch chan string, msgs ...string) {
+		for _, msg := range msgs {
+			select {
+			case got := <-ch:
+				if got != msg {
+					t.Errorf("unexpected msg %s, expect %s", got, msg)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%s not received", msg)
+			}
+		}
+		select {
+		case got := <-ch:
+			t.Errorf("unexpected msg %s", got)
+		case <-time.After(30 * time.Millisecond):
+		}
+	}
+
+	if owner, _ := c.Owner("b1"); owner != "b" {
+		t.Errorf("unexpected owner %s", owner)
+	}
+
+	c.Dispatch(TextMessage, []byte("all"))
+	expect(a1, "all")
+	expect(b1, "all")
+	expect(b2, "all")
+
+	a.ToGroup("g1", TextMessage, []byte("g1"))
+	expect(a1, "g1")
+	expect(b1, "g1")
+	expect(b2)
+
+	if len(c.ToPick("b2", TextMessage, []byte("pick")).Accepted) != 1 || len(c.ToPick("nobody", TextMessage, nil).Failed) != 1 {
+		t.Error("unexpected pick result")
+	}
+	expect(b2, "pick")
+
+	c.Except("b1", TextMessage, []byte("except"))
+	expect(a1, "except")
+	expect(b1)
+	expect(b2, "except")
+
+	// node leaving
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if e := b.Shutdown(ctx); e != nil {
+		t.Fatal(e)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := a.Owner("b1"); ok {
+		t.Error("owner of left node is kept")
+	}
+	if strings.Join(a.Peers(), ",") != "c" {
+		t.Errorf("unexpected peers %v", a.Peers())
+	}
+}
+
+func TestClusterNegotiate(t *testing.T) {
+	a, aURL := newClusterNode(t, &ClusterConfig{NodeID: "a"})
+	// plain connections are not cluster nodes
+	ws, e := Dial(aURL+"/peer", nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	closed := make(chan struct{})
+	ws.OnStatus(StatusClosed, func(s Status, a Adapter) {
+		close(closed)
+	})
+	go ws.Start()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("peer without cluster negotiated is not closed")
+	}
+	if len(a.Peers()) != 0 {
+		t.Errorf("unexpected peers %v", a.Peers())
+	}
+}
+
+func TestClusterDiscover(t *testing.T) {
+	a, aURL := newClusterNode(t, &ClusterConfig{NodeID: "a"})
+	var lock sync.Mutex
+	var discovered []string
+	b, _ := newClusterNode(t, &ClusterConfig{
+		NodeID:           "b",
+		DiscoverInterval: 20 * time.Millisecond,
+		Discover: func() []string {
+			lock.Lock()
+			defer lock.Unlock()
+			return discovered
+		},
+	})
+	defer b.Close()
+	time.Sleep(30 * time.Millisecond)
+	if len(b.Peers()) != 0 {
+		t.Fatalf("unexpected peers %v", b.Peers())
+	}
+
+	// peers discovered later are connected in the next round
+	lock.Lock()
+	discovered = []string{aURL + "/peer"}
+	lock.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	if strings.Join(b.Peers(), ",") != "a" || strings.Join(a.Peers(), ",") != "b" {
+		t.Fatalf("unexpected peers %v %v", b.Peers(), a.Peers())
+	}
+
+	// lost peers are connected again
+	var lost Adapter
+	a.peers.Range(func(p Adapter) bool {
+		lost = p
+		p.Close()
+		return true
+	})
+	reconnected := false
+	for deadline := time.Now().Add(time.Second); !reconnected && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		a.peers.Range(func(p Adapter) bool {
+			reconnected = p != lost
+			return false
+		})
+	}
+	// wait for hello
+	time.Sleep(20 * time.Millisecond)
+	if !reconnected || strings.Join(b.Peers(), ",") != "a" {
+		t.Errorf("lost peer is not connected again %v", b.Peers())
+	}
+}
@@ -0,0 +1,248 @@
+package webson
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Codec encodes values to message payload and decodes them back.
+// Implement it for other formats like protobuf.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	MessageType() MessageType // message type used for dispatching encoded payload
+}
+
+// JSONCodec is the default codec, payload is sent as TextMessage
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (JSONCodec) MessageType() MessageType           { return TextMessage }
+
+// GobCodec encodes with encoding/gob, payload is sent as BinaryMessage
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if e := gob.NewEncoder(&buf).Encode(v); e != nil {
+		return nil, e
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (GobCodec) MessageType() MessageType { return BinaryMessage }
+
+// typed envelope is a json object like {"type": topic, "data": encoded data} by default,
+// so that browsers can send & parse it as plain json. Name of the topic field is Config.TypeField.
+// Data is kept raw so that it's decoded only when the topic is routed.
+const envelopeData = "data"
+
+func wrapEnvelope(field, topic string, data []byte) ([]byte, error) {
+	if !json.Valid(data) {
+		return nil, errors.New("codec doesn't produce json, enable FramedEnvelope")
+	}
+	return json.Marshal(map[string]any{field: topic, envelopeData: json.RawMessage(data)})
+}
+
+// unwrapEnvelope returns ok false if raw is not an envelope,
+// which is not a json object or has no topic in the field
+func unwrapEnvelope(field string, raw []byte) (topic string, data []byte, ok bool) {
+	var env map[string]json.RawMessage
+	if json.Unmarshal(raw, &env) != nil {
+		return "", nil, false
+	}
+	if json.Unmarshal(env[field], &topic) != nil || topic == "" {
+		return "", nil, false
+	}
+	data = env[envelopeData]
+	if data == nil {
+		data = []byte("null")
+	}
+	return topic, data, true
+}
+
+// framed envelope is marker | topic | separator | encoded data, it's framed without the codec,
+// so that codecs not producing json work too. It's enabled by Config.FramedEnvelope.
+const envelopeMarker = "\x1ewebson\x1e"
+const envelopeSeparator = '\x1e'
+
+func wrapFramedEnvelope(topic string, data []byte) ([]byte, error) {
+	if strings.IndexByte(topic, envelopeSeparator) >= 0 {
+		return nil, errors.New("invalid char in topic")
+	}
+	raw := make([]byte, 0, len(envelopeMarker)+len(topic)+1+len(data))
+	raw = append(raw, envelopeMarker...)
+	raw = append(raw, topic...)
+	raw = append(raw, envelopeSeparator)
+	return append(raw, data...), nil
+}
+
+// unwrapFramedEnvelope returns ok false if raw is not an envelope
+func unwrapFramedEnvelope(raw []byte) (topic string, data []byte, ok bool, err error) {
+	if !bytes.HasPrefix(raw, []byte(envelopeMarker)) {
+		return "", nil, false, nil
+	}
+	raw = raw[len(envelopeMarker):]
+	end := bytes.IndexByte(raw, envelopeSeparator)
+	if end < 0 {
+		return "", nil, true, errors.New("broken envelope")
+	}
+	return string(raw[:end]), raw[end+1:], true, nil
+}
+
+// DispatchJSON encodes v as json and dispatch it as TextMessage
+func DispatchJSON(a Adapter, v any) error {
+	return DispatchWith(a, JSONCodec{}, v)
+}
+
+// DispatchWith encodes v with the codec and dispatch it
+func DispatchWith(a Adapter, c Codec, v any) error {
+	payload, e := c.Marshal(v)
+	if e != nil {
+		return e
+	}
+	return a.Dispatch(c.MessageType(), payload)
+}
+
+// DispatchTyped wraps v in an envelope with the topic, so that it's routed to OnTyped handler of the other side.
+// Codec of the connection is used, both sides should use the same codec.
+func DispatchTyped(a Adapter, topic string, v any) error {
+	c := codecOf(a)
+	data, e := c.Marshal(v)
+	if e != nil {
+		return e
+	}
+	var payload []byte
+	if field, framed := envelopeOf(a); framed {
+		payload, e = wrapFramedEnvelope(topic, data)
+	} else {
+		payload, e = wrapEnvelope(field, topic, data)
+	}
+	if e != nil {
+		return e
+	}
+	return a.Dispatch(c.MessageType(), payload)
+}
+
+// Decode the complete message payload into v with the codec of the connection
+func (m *Message) Decode(v any) error {
+	payload, e := m.Read()
+	if e != nil {
+		return e
+	}
+	c := Codec(JSONCodec{})
+	if m.config != nil && m.config.codec != nil {
+		c = m.config.codec
+	}
+	return c.Unmarshal(payload, v)
+}
+
+// codecOf finds codec of the adapter, json for adapters other than *Connection
+func codecOf(a Adapter) Codec {
+	if con, ok := a.(*Connection); ok && con.config.Codec != nil {
+		return con.config.Codec
+	}
+	return JSONCodec{}
+}
+
+// envelopeOf finds envelope settings of the adapter, defaults for adapters other than *Connection
+func envelopeOf(a Adapter) (field string, framed bool) {
+	field = DEFAULT_TYPE_FIELD
+	if con, ok := a.(*Connection); ok && con.config != nil {
+		if con.config.TypeField != "" {
+			field = con.config.TypeField
+		}
+		framed = con.config.FramedEnvelope
+	}
+	return
+}
+
+// OnTyped binds handler for messages dispatched by DispatchTyped with the topic.
+// Data is decoded as T, failures are reported to Config.OnDecodeError.
+func OnTyped[T any](con *Connection, topic string, action func(T, Adapter)) {
+	con.typedRouter().bind(topic, func(data []byte, a Adapter) error {
+		var v T
+		if e := codecOf(a).Unmarshal(data, &v); e != nil {
+			return e
+		}
+		action(v, a)
+		return nil
+	})
+}
+
+func (con *Connection) typedRouter() *typedRouter {
+	con.routerOnce.Do(func() {
+		con.router = &typedRouter{routes: make(map[string]func([]byte, Adapter) error)}
+		con.Apply(con.router)
+	})
+	return con.router
+}
+
+// typedRouter routes envelopes by topic, it's applied to the connection on first OnTyped
+type typedRouter struct {
+	lock   sync.RWMutex
+	routes map[string]func([]byte, Adapter) error
+}
+
+func (r *typedRouter) bind(topic string, route func([]byte, Adapter) error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routes[topic] = route
+}
+
+func (r *typedRouter) Name() string {
+	return "webson-typed"
+}
+
+func (r *typedRouter) OnStatus(s Status, a Adapter) {}
+
+func (r *typedRouter) OnMessage(m *Message, a Adapter) {
+	c := codecOf(a)
+	if m.Type != c.MessageType() {
+		return
+	}
+	raw, e := m.readComplete()
+	if e != nil {
+		return
+	}
+	// ordinary msgs without the topic or the marker are not for the router
+	var topic string
+	var data []byte
+	var ok bool
+	if field, framed := envelopeOf(a); framed {
+		topic, data, ok, e = unwrapFramedEnvelope(raw)
+		if !ok {
+			return
+		}
+		if e != nil {
+			reportDecodeError(&DecodeError{Err: e}, m, a)
+			return
+		}
+	} else if topic, data, ok = unwrapEnvelope(field, raw); !ok {
+		return
+	}
+	r.lock.RLock()
+	route, ok := r.routes[topic]
+	r.lock.RUnlock()
+	if !ok {
+		return
+	}
+	if e := route(data, a); e != nil {
+		reportDecodeError(&DecodeError{Topic: topic, Err: e}, m, a)
+	}
+}
+
+func reportDecodeError(e *DecodeError, m *Message, a Adapter) {
+	if con, ok := a.(*Connection); ok && con.config.OnDecodeError != nil {
+		con.config.OnDecodeError(e, m, a)
+	}
+}
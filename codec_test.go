@@ -0,0 +1,248 @@
+package webson
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type typedPoint struct {
+	X, Y int
+}
+
+// bytesCodec only works with bytes, like codecs generated for specific messages
+type bytesCodec struct{}
+
+func (bytesCodec) Marshal(v any) ([]byte, error) {
+	if b, ok := v.([]byte); ok {
+		return b, nil
+	}
+	return nil, errors.New("bytes only")
+}
+
+func (bytesCodec) Unmarshal(data []byte, v any) error {
+	if b, ok := v.(*[]byte); ok {
+		*b = append([]byte(nil), data...)
+		return nil
+	}
+	return errors.New("bytes only")
+}
+
+func (bytesCodec) MessageType() MessageType { return BinaryMessage }
+
+func TestTypedBytesCodec(t *testing.T) {
+	received := make(chan []byte, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, &Config{Codec: bytesCodec{}, FramedEnvelope: true})
+		if e != nil {
+			return
+		}
+		OnTyped(ws, "raw", func(p []byte, a Adapter) {
+			received <- p
+		})
+		ws.Start()
+	}))
+	defer s.Close()
+	ws, e := Dial(s.URL, &DialConfig{Config: Config{Codec: bytesCodec{}, FramedEnvelope: true}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	go ws.Start()
+	defer ws.Close()
+	time.Sleep(10 * time.Millisecond)
+	if e := DispatchTyped(ws, "raw", []byte("webson")); e != nil {
+		t.Fatal(e)
+	}
+	select {
+	case p := <-received:
+		if string(p) != "webson" {
+			t.Errorf("unexpected payload %s", p)
+		}
+	case <-time.After(time.Second):
+		t.Error("typed message not received")
+	}
+	if e := DispatchTyped(ws, "bad\x1etopic", []byte("x")); e == nil {
+		t.Error("topic with separator is dispatched")
+	}
+	ws.config.FramedEnvelope = false
+	if e := DispatchTyped(ws, "raw", []byte("webson")); e == nil {
+		t.Error("non json data is dispatched in json envelope")
+	}
+}
+
+func TestTypedMessage(t *testing.T) {
+	for _, c := range []Config{
+		{},
+		{TypeField: "kind"},
+		{Codec: GobCodec{}, FramedEnvelope: true},
+	} {
+		codec := c.Codec
+		if codec == nil {
+			codec = JSONCodec{}
+		}
+		received := make(chan typedPoint, 1)
+		failed := make(chan error, 1)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			config := c
+			config.OnDecodeError = func(e error, m *Message, a Adapter) {
+				failed <- e
+			}
+			ws, e := TakeOver(w, r, &config)
+			if e != nil {
+				return
+			}
+			OnTyped(ws, "point", func(p typedPoint, a Adapter) {
+				received <- p
+			})
+			OnTyped(ws, "name", func(name string, a Adapter) {
+				t.Error("unexpected name", name)
+			})
+			ws.Start()
+		}))
+
+		ws, e := Dial(s.URL, &DialConfig{Config: c})
+		if e != nil {
+			t.Fatal(e)
+		}
+		go ws.Start()
+		time.Sleep(10 * time.Millisecond)
+
+		if e := DispatchTyped(ws, "point", typedPoint{1, 2}); e != nil {
+			t.Fatal(e)
+		}
+		select {
+		case p := <-received:
+			if p != (typedPoint{1, 2}) {
+				t.Errorf("unexpected point %v", p)
+			}
+		case <-time.After(time.Second):
+			t.Error("typed message not received")
+		}
+
+		// topic without handler is ignored
+		DispatchTyped(ws, "other", typedPoint{})
+		// data not matching the topic type
+		DispatchTyped(ws, "name", typedPoint{3, 4})
+		select {
+		case e := <-failed:
+			var de *DecodeError
+			if !errors.As(e, &de) || de.Topic != "name" {
+				t.Errorf("unexpected error %v", e)
+			}
+		case <-time.After(time.Second):
+			t.Error("decode error not reported")
+		}
+		// ordinary msgs are not reported
+		for _, plain := range []string{"plain", `{"type":""}`, `{"data":1}`, `[1]`} {
+			ws.Dispatch(codec.MessageType(), []byte(plain))
+		}
+		select {
+		case e := <-failed:
+			t.Errorf("ordinary msg is reported %v", e)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if c.FramedEnvelope {
+			// broken envelope
+			ws.Dispatch(codec.MessageType(), []byte(envelopeMarker+"broken"))
+			select {
+			case e := <-failed:
+				var de *DecodeError
+				if !errors.As(e, &de) || de.Topic != "" {
+					t.Errorf("unexpected error %v", e)
+				}
+			case <-time.After(time.Second):
+				t.Error("decode error not reported")
+			}
+		}
+
+		ws.Close()
+		s.Close()
+	}
+}
+
+func TestTypedJSONEnvelope(t *testing.T) {
+	received := make(chan typedPoint, 1)
+	decoded := make(chan typedPoint, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, nil)
+		if e != nil {
+			return
+		}
+		OnTyped(ws, "point", func(p typedPoint, a Adapter) {
+			received <- p
+			DispatchTyped(a, "ack", p)
+		})
+		// ordinary handlers still get typed messages as plain json
+		ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+			var env struct {
+				Type string
+				Data typedPoint
+			}
+			if e := m.Decode(&env); e != nil || env.Type != "point" {
+				t.Errorf("unexpected envelope %v %v", env, e)
+			}
+			decoded <- env.Data
+		})
+		ws.Start()
+	}))
+	defer s.Close()
+	ws, e := Dial(s.URL, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	acked := make(chan string, 1)
+	ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+		payload, _ := m.Read()
+		acked <- string(payload)
+	})
+	go ws.Start()
+	defer ws.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	// like sent by a browser, field order & spaces don't matter
+	ws.Dispatch(TextMessage, []byte(`{ "data": {"X": 7, "Y": 8}, "type": "point" }`))
+	for _, ch := range []chan typedPoint{received, decoded} {
+		select {
+		case p := <-ch:
+			if p != (typedPoint{7, 8}) {
+				t.Errorf("unexpected point %v", p)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("typed message not received")
+		}
+	}
+	select {
+	case ack := <-acked:
+		if ack != `{"data":{"X":7,"Y":8},"type":"ack"}` {
+			t.Errorf("unexpected envelope %s", ack)
+		}
+	case <-time.After(time.Second):
+		t.Error("ack not received")
+	}
+}
+
+func TestDispatchJSON(t *testing.T) {
+	s := newEchoServer(t, nil)
+	ws, e := Dial(s.URL, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	received := make(chan typedPoint, 1)
+	ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+		var p typedPoint
+		if e := m.Decode(&p); e != nil {
+			t.Error(e)
+		}
+		received <- p
+		a.Close()
+	})
+	ws.OnReady(func(a Adapter) {
+		DispatchJSON(a, typedPoint{5, 6})
+	})
+	ws.Start()
+	if p := <-received; p != (typedPoint{5, 6}) {
+		t.Errorf("unexpected point %v", p)
+	}
+}
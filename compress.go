@@ -0,0 +1,288 @@
+package webson
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// flate in golang always works with 32k window, smaller window for compression is not supported
+const maxWindowBits = 15
+const minWindowBits = 8
+const maxWindowSize = 1 << maxWindowBits
+
+// deflateTail is the sync flush tail removed from every message, with a final block to end the reading
+var deflateTail = []byte("\x00\x00\xff\xff\x01\x00\x00\xff\xff")
+
+// deflateParams is the negotiated permessage-deflate parameters, see RFC7692
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+
+	serverMaxWindowBits int // 0 if not given
+	clientMaxWindowBits int // 0 if not given, -1 if given without value
+}
+
+func (p *deflateParams) String() string {
+	ext := "permessage-deflate"
+	if p.serverNoContextTakeover {
+		ext += "; server_no_context_takeover"
+	}
+	if p.clientNoContextTakeover {
+		ext += "; client_no_context_takeover"
+	}
+	if p.serverMaxWindowBits > 0 {
+		ext += "; server_max_window_bits=" + strconv.Itoa(p.serverMaxWindowBits)
+	}
+	if p.clientMaxWindowBits > 0 {
+		ext += "; client_max_window_bits=" + strconv.Itoa(p.clientMaxWindowBits)
+	} else if p.clientMaxWindowBits < 0 {
+		ext += "; client_max_window_bits"
+	}
+	return ext
+}
+
+// parseDeflateParams finds all permessage-deflate offers (or response) in Sec-Websocket-Extensions headers.
+// Invalid offers will be returned as errors in their places.
+func parseDeflateParams(values []string) (offers []*deflateParams, errs []error) {
+	for _, value := range values {
+		for _, ext := range strings.Split(value, ",") {
+			parts := strings.Split(ext, ";")
+			if strings.TrimSpace(parts[0]) != "permessage-deflate" {
+				continue
+			}
+			p, e := parseDeflateOffer(parts[1:])
+			offers = append(offers, p)
+			errs = append(errs, e)
+		}
+	}
+	return
+}
+
+func parseDeflateOffer(params []string) (*deflateParams, error) {
+	p := &deflateParams{}
+	seen := make(map[string]bool)
+	for _, param := range params {
+		key, value := strings.TrimSpace(param), ""
+		if i := strings.Index(key, "="); i > 0 {
+			key, value = strings.TrimSpace(key[:i]), strings.Trim(strings.TrimSpace(key[i+1:]), "\"")
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("duplicated extension param %s", key)
+		}
+		seen[key] = true
+
+		switch key {
+		case "server_no_context_takeover":
+			p.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			p.clientNoContextTakeover = true
+		case "server_max_window_bits", "client_max_window_bits":
+			bits := -1
+			if value != "" {
+				var e error
+				if bits, e = strconv.Atoi(value); e != nil || bits < minWindowBits || bits > maxWindowBits {
+					return nil, fmt.Errorf("invalid %s %s", key, value)
+				}
+			} else if key == "server_max_window_bits" {
+				return nil, errors.New("server_max_window_bits without value")
+			}
+			if key == "server_max_window_bits" {
+				p.serverMaxWindowBits = bits
+			} else {
+				p.clientMaxWindowBits = bits
+			}
+		default:
+			return nil, fmt.Errorf("unknown extension param %s", key)
+		}
+	}
+	return p, nil
+}
+
+// compressor keeps deflate state for outgoing messages of one connection or one message
+type compressor struct {
+	buf      bytes.Buffer
+	w        *flate.Writer
+	takeover bool
+}
+
+func newCompressor(level int, takeover bool) (*compressor, error) {
+	c := &compressor{takeover: takeover}
+	w, e := flate.NewWriter(&c.buf, level)
+	if e != nil {
+		return nil, e
+	}
+	c.w = w
+	return c, nil
+}
+
+// compress writes one chunk of the message, tail of the message will be removed at the end.
+// Returned bytes are only valid before next compress.
+func (c *compressor) compress(p []byte, end bool) ([]byte, error) {
+	c.buf.Reset()
+	if _, e := c.w.Write(p); e != nil {
+		return nil, e
+	}
+	if e := c.w.Flush(); e != nil {
+		return nil, e
+	}
+	out := c.buf.Bytes()
+	if end {
+		out = out[:len(out)-4]
+		if !c.takeover {
+			c.w.Reset(&c.buf)
+		}
+	}
+	return out, nil
+}
+
+// decompressor keeps the sliding window of other side for context takeover
+type decompressor struct {
+	r    io.ReadCloser
+	dict []byte
+	lock sync.Mutex // held by the streaming msg until it's read to the end
+}
+
+func newDecompressor() *decompressor {
+	return &decompressor{r: flate.NewReader(bytes.NewReader(nil))}
+}
+
+// decompress one complete message, messages must be decompressed by the order they are received
+func (d *decompressor) decompress(p []byte) ([]byte, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if e := d.r.(flate.Resetter).Reset(io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail)), d.dict); e != nil {
+		return nil, e
+	}
+	out, e := io.ReadAll(d.r)
+	if e != nil {
+		return nil, e
+	}
+	d.remember(out)
+	return out, nil
+}
+
+// stream decompresses one message on the fly, output should be remembered and release it after the message is read.
+// Messages after it will wait for the release.
+func (d *decompressor) stream(src io.Reader) (io.Reader, error) {
+	d.lock.Lock()
+	if e := d.r.(flate.Resetter).Reset(io.MultiReader(src, bytes.NewReader(deflateTail)), d.dict); e != nil {
+		d.lock.Unlock()
+		return nil, e
+	}
+	return d.r, nil
+}
+
+func (d *decompressor) release() {
+	d.lock.Unlock()
+}
+
+// remember decompressed output in the sliding window
+func (d *decompressor) remember(out []byte) {
+	d.dict = append(d.dict, out...)
+	if len(d.dict) > maxWindowSize {
+		d.dict = append([]byte(nil), d.dict[len(d.dict)-maxWindowSize:]...)
+	}
+}
+
+// offerDeflate creates the client offer, context takeover is not allowed with streams
+func (c *Config) offerDeflate() *deflateParams {
+	offer := &deflateParams{
+		serverNoContextTakeover: c.ServerNoContextTakeover || c.EnableStreams,
+		clientNoContextTakeover: c.ClientNoContextTakeover || c.EnableStreams,
+		serverMaxWindowBits:     c.ServerMaxWindowBits,
+		clientMaxWindowBits:     c.ClientMaxWindowBits,
+	}
+	if offer.clientMaxWindowBits == 0 {
+		// server is free to limit client window
+		offer.clientMaxWindowBits = -1
+	}
+	return offer
+}
+
+// acceptDeflate creates the server response for the client offer
+func (c *Config) acceptDeflate(offer *deflateParams, streamable bool) *deflateParams {
+	resp := &deflateParams{
+		serverNoContextTakeover: offer.serverNoContextTakeover || c.ServerNoContextTakeover || streamable,
+		clientNoContextTakeover: offer.clientNoContextTakeover || c.ClientNoContextTakeover || streamable,
+		serverMaxWindowBits:     offer.serverMaxWindowBits,
+	}
+	if c.ServerMaxWindowBits > 0 && (resp.serverMaxWindowBits == 0 || c.ServerMaxWindowBits < resp.serverMaxWindowBits) {
+		resp.serverMaxWindowBits = c.ServerMaxWindowBits
+	}
+	// client window can only be limited when client offered client_max_window_bits
+	if offer.clientMaxWindowBits != 0 && c.ClientMaxWindowBits > 0 {
+		resp.clientMaxWindowBits = c.ClientMaxWindowBits
+		if offer.clientMaxWindowBits > 0 && offer.clientMaxWindowBits < resp.clientMaxWindowBits {
+			resp.clientMaxWindowBits = offer.clientMaxWindowBits
+		}
+	}
+	return resp
+}
+
+// verifyDeflate checks server response for the client offer
+func (offer *deflateParams) verifyDeflate(resp *deflateParams) error {
+	if offer.serverNoContextTakeover && !resp.serverNoContextTakeover {
+		return errors.New("server_no_context_takeover not accepted")
+	}
+	if resp.clientMaxWindowBits < 0 {
+		return errors.New("client_max_window_bits without value")
+	}
+	if offer.serverMaxWindowBits > 0 &&
+		(resp.serverMaxWindowBits == 0 || resp.serverMaxWindowBits > offer.serverMaxWindowBits) {
+		return errors.New("server_max_window_bits not accepted")
+	}
+	if offer.clientMaxWindowBits > 0 && resp.clientMaxWindowBits > offer.clientMaxWindowBits {
+		return errors.New("client_max_window_bits exceeded")
+	}
+	return nil
+}
+
+// deflateSet apply negotiated params to this side, local & remote window is decided by isClient
+func (n *negoSet) deflateSet(p *deflateParams, level int, isClient bool) {
+	n.compressable = true
+	n.compressLevel = level
+	if n.compressLevel == 0 {
+		n.compressLevel = DEFAULT_COMPRESS_LEVEL
+	}
+	localNoTakeover, remoteNoTakeover, localBits := p.serverNoContextTakeover, p.clientNoContextTakeover, p.serverMaxWindowBits
+	if isClient {
+		localNoTakeover, remoteNoTakeover, localBits = p.clientNoContextTakeover, p.serverNoContextTakeover, p.clientMaxWindowBits
+	}
+	n.deflateTakeover = !localNoTakeover && !n.streamable
+	n.inflateTakeover = !remoteNoTakeover && !n.streamable
+	// it's ok to send uncompressed messages if this side can't limit its window
+	n.deflateDisabled = localBits > 0 && localBits < maxWindowBits
+}
+
+// compressorFor returns the shared compressor if context takeover, or a new one for single message
+func (con *Connection) compressorFor() (*compressor, error) {
+	if con.deflater != nil {
+		return con.deflater, nil
+	}
+	return newCompressor(con.compressLevel, false)
+}
+
+func (con *Connection) setupCompress() error {
+	con.deflater = nil
+	con.inflater = nil
+	if !con.compressable {
+		return nil
+	}
+	if con.deflateTakeover && !con.deflateDisabled {
+		c, e := newCompressor(con.compressLevel, true)
+		if e != nil {
+			return e
+		}
+		con.deflater = c
+	}
+	if con.inflateTakeover {
+		con.inflater = newDecompressor()
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package webson
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeflateParams(t *testing.T) {
+	offers, errs := parseDeflateParams([]string{
+		`permessage-deflate; client_max_window_bits; server_max_window_bits="10", x-webkit-deflate-frame`,
+		`permessage-deflate; server_max_window_bits=16`,
+		`permessage-deflate;client_no_context_takeover;  server_no_context_takeover`,
+	})
+	if len(offers) != 3 {
+		t.Fatalf("unexpected offers %d", len(offers))
+	}
+	if errs[0] != nil || offers[0].clientMaxWindowBits != -1 || offers[0].serverMaxWindowBits != 10 {
+		t.Errorf("unexpected offer %v %v", offers[0], errs[0])
+	}
+	if errs[1] == nil {
+		t.Error("invalid window bits accepted")
+	}
+	resp := (&Config{}).acceptDeflate(offers[2], false)
+	if resp.String() != "permessage-deflate; server_no_context_takeover; client_no_context_takeover" {
+		t.Errorf("unexpected response %s", resp)
+	}
+}
+
+func TestCompressTakeover(t *testing.T) {
+	for _, c := range []struct {
+		name              string
+		server, client    Config
+		takeover, enabled bool
+	}{
+		{"takeover", Config{EnableCompress: true}, Config{EnableCompress: true}, true, true},
+		{"no takeover", Config{EnableCompress: true, ServerNoContextTakeover: true},
+			Config{EnableCompress: true, ClientNoContextTakeover: true}, false, true},
+		{"limited window", Config{EnableCompress: true, ClientMaxWindowBits: 10}, Config{EnableCompress: true}, false, false},
+		{"streams", Config{EnableCompress: true, EnableStreams: true},
+			Config{EnableCompress: true, EnableStreams: true}, false, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server := c.server
+			// async handlers may echo in any order, while echoes are compared in the sent order below
+			server.Synchronize = true
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, e := TakeOver(w, r, &server)
+				if e != nil {
+					return
+				}
+				ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+					msg, _ := m.Read()
+					a.Dispatch(TextMessage, msg)
+				})
+				ws.Start()
+			}))
+			defer s.Close()
+
+			client := c.client
+			client.Synchronize = true
+			ws, e := Dial(s.URL, &DialConfig{Config: client})
+			if e != nil {
+				t.Fatal(e)
+			}
+			if !ws.compressable || (ws.deflater != nil) != c.takeover || ws.deflateDisabled == c.enabled {
+				t.Fatalf("unexpected negotiation %+v", ws.negoSet)
+			}
+			var sent [][]byte
+			for i := 0; i < 20; i++ {
+				// larger than chunk size to be fragmented
+				sent = append(sent, bytes.Repeat([]byte(fmt.Sprintf(`{"id": %d, "name": "webson"}`, i)), 300))
+			}
+			received := make(chan []byte, len(sent))
+			ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+				msg, e := m.Read()
+				if e != nil {
+					t.Error(e)
+				}
+				received <- msg
+			})
+			ws.OnReady(func(a Adapter) {
+				for _, msg := range sent {
+					if e := a.Dispatch(TextMessage, msg); e != nil {
+						t.Error(e)
+					}
+				}
+			})
+			go ws.Start()
+			defer ws.Close()
+			for _, msg := range sent {
+				select {
+				case r := <-received:
+					if !bytes.Equal(r, msg) {
+						t.Fatalf("unexpected echo %q %d %d", r[:20], len(r), len(msg))
+					}
+				case <-time.After(3 * time.Second):
+					t.Fatal("echo timeout")
+				}
+			}
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package webson
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
+	"time"
 )
 
 // PoolConfig is for creating a pool
@@ -13,29 +15,77 @@ type PoolConfig struct {
 	Size          int    // max connections the pool can hold, 0 to be unlimited
 	ClientRetry   int    // client retry count
 	RetryInterval int    // client retry interval
+
+	WriteQueue   int           // broadcast queue size for every connection, DEFAULT_WRITE_QUEUE if 0
+	SlowPolicy   SlowPolicy    // what to do when a connection's broadcast queue is full
+	BlockTimeout time.Duration // max wait time of one broadcast for SlowBlock
+
+	CloseCode *CloseCode // sent to connections when the pool shuts down, like GoingAway or ServiceRestart. NormalClosure if nil
 }
 
 // NodeConfig is for node append in a pool
 type NodeConfig struct {
-	Name  string // node name, will be a random string if empty
-	Group string // node group
+	Name   string   // node name, will be a random string if empty
+	Group  string   // initial node group, Adapter.Group() keeps it even after Pool.Leave
+	Groups []string // more groups the node belongs to, groups can be joined or left later in the pool
+}
+
+// NodeRole tells where the connection comes from
+type NodeRole int
+
+const (
+	RoleServer = NodeRole(0) // from TakeOver
+	RoleClient = NodeRole(1) // from Dial
+)
+
+func (r NodeRole) String() string {
+	if r == RoleClient {
+		return "client"
+	}
+	return "server"
+}
+
+// NodeInfo is the snapshot of one connection in a pool
+type NodeInfo struct {
+	Name           string
+	Role           NodeRole
+	Group          string   // the initial group, not changed by Join & Leave
+	Groups         []string // all groups joined currently
+	Status         Status
+	ConnectedSince time.Time // last time it's ready, zero if never
 }
 
 // actual config for one webson connection after negotiation
 type negoSet struct {
 	streamable bool
 	maxStreams int
+	sendWindow int // stream window granted by other side, 0 if flow control is disabled
+	recvWindow int // stream window granted to other side, 0 if flow control is disabled
 
-	compressable  bool
-	compressLevel int
+	subprotocol string
+
+	rpc     bool // RPCMessage is negotiated
+	cluster bool // ClusterMessage is negotiated
+
+	compressable    bool
+	compressLevel   int
+	deflateTakeover bool // this side keeps compress context between messages
+	inflateTakeover bool // other side keeps compress context between messages
+	deflateDisabled bool // this side's window is limited below flate supports, messages are sent uncompressed
 }
 
 type msgConfig struct {
 	negotiate *negoSet
 
+	inflater *decompressor
+	codec    Codec
+
 	extraMask      []byte
 	triggerOnStart bool
 	synchronized   bool
+
+	pullFrame func() error // reads the next frame from connection, for msg reader in synchronized handler
+	flow      *streamFlow  // nil if flow control is disabled
 }
 
 // DialConfig is for client Dial, combined with general webson Config & client only ClientConfig
@@ -47,12 +97,59 @@ type DialConfig struct {
 // ClientConfig is for client connection config when negotiating with server
 type ClientConfig struct {
 	url    *simpleUrl
-	dialer func() (net.Conn, error)
+	dialer func(context.Context) (net.Conn, error)
 
 	UseTLS    bool        // use TLS connection no matter the what's the url
 	TLSConfig *tls.Config // TLS config for this connection
 
-	ExtraHeaders map[string]string // extra http headers sent for upgrading
+	ExtraHeaders  map[string]string        // extra http headers sent for upgrading
+	HeaderRefresh func() map[string]string // extra http headers created for every handshake, like refreshed tokens
+
+	Reconnect *Reconnect // auto reconnect policy, nil to disable
+
+	Proxy        string // proxy url, http://, https://, socks5:// supported, user info for proxy auth
+	ProxyFromEnv bool   // use proxy from HTTP_PROXY, HTTPS_PROXY & NO_PROXY if Proxy is not set
+
+	// NetDial replaces the default dialing, it takes the host:port from url. Proxy settings will be ignored.
+	// TLS is layered on the returned connection for wss or TLSConfig, unless it's a *tls.Conn already.
+	NetDial func(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// Reconnect is the auto reconnect policy for client connection.
+// Connection will try to reconnect unless it's closed by this side.
+type Reconnect struct {
+	MaxAttempts int           // max attempts for one disconnection, 0 to be unlimited
+	MinDelay    time.Duration // delay before the first attempt
+	MaxDelay    time.Duration // max delay between attempts
+	Factor      float64       // delay grows by Factor after every failed attempt
+	Jitter      float64       // random jitter ratio of the delay, 0 ~ 1
+	BufferSize  int           // max messages buffered while reconnecting, shortcut of Config.SendQueue if it's not set
+}
+
+func (r *Reconnect) setup() {
+	if r.MinDelay <= 0 {
+		r.MinDelay = DEFAULT_RECONNECT_MIN_DELAY
+	}
+	if r.MaxDelay < r.MinDelay {
+		r.MaxDelay = DEFAULT_RECONNECT_MAX_DELAY
+		if r.MaxDelay < r.MinDelay {
+			r.MaxDelay = r.MinDelay
+		}
+	}
+	if r.Factor < 1 {
+		r.Factor = DEFAULT_RECONNECT_FACTOR
+	}
+	if r.Jitter < 0 || r.Jitter > 1 {
+		r.Jitter = DEFAULT_RECONNECT_JITTER
+	}
+}
+
+// SendQueue buffers data messages dispatched when connection is not ready yet, timeout or reconnecting.
+// Buffered messages will be sent in order once it's ready again.
+type SendQueue struct {
+	Size   int           // max messages the queue can hold
+	Policy QueuePolicy   // what to do when the queue is full
+	Expire time.Duration // messages expired will be dropped, 0 to never expire
 }
 
 // Timeout is the config for all timeouts
@@ -65,20 +162,45 @@ type Timeout struct {
 // Config is the programer preferred options
 type Config struct {
 	HeaderVerify func(http.Header) bool // verify http headers when upgrade connections
+	// UpgradeVerify verify the whole request when upgrade connections, headers added to resp will be sent with 101 response.
+	// Return an error to reject, *UpgradeError (may be wrapped) for custom status & body.
+	UpgradeVerify func(r *http.Request, resp http.Header) error
+
+	AllowedOrigins []string                 // origin patterns allowed besides same origin, like "*.example.com" or "https://*.example.com"
+	CheckOrigin    func(*http.Request) bool // replace the default origin check
+
+	Subprotocols      []string                      // subprotocols offered by client by preference, or supported by server
+	SelectSubprotocol func(offered []string) string // server side selection from client offered, "" for none
 
 	EnableStreams  bool // allow streaming for this connection
 	MaxStreams     int  // max streams this side can take. little one will be choosed.
+	StreamWindow   int  // receive window of every stream in bytes, DEFAULT_STREAM_WINDOW if 0, -1 to disable flow control
 	ChunkSize      int  // max fragment payloa size
 	BufferSize     int  // buffer size for reading from connection
 	MaxPayloadSize int  // single data frame size limit
 	TriggerOnStart bool // message trigger on first fragment
 	Synchronize    bool // handlers will be triggered on the main goroutine with the Start
+	PullBuffer     int  // msgs buffered for ReadMessage before the read loop waits, DEFAULT_PULL_BUFFER if 0, -1 for none
 
-	EnableCompress bool // allow compression for this connection
-	CompressLevel  int  // compress level defined in deflate
+	EnableRPC     bool // allow RPC frames, it's negotiated in handshake, both sides should enable it
+	EnableCluster bool // allow ClusterPool frames, it's enabled by ClusterPool for peers
+
+	EnableCompress          bool // allow compression for this connection
+	CompressLevel           int  // compress level defined in deflate
+	ServerNoContextTakeover bool // server compress every message with fresh context
+	ClientNoContextTakeover bool // client compress every message with fresh context
+	ServerMaxWindowBits     int  // max window bits for server compression, 8 ~ 15
+	ClientMaxWindowBits     int  // max window bits for client compression, 8 ~ 15
 
 	Timeout *Timeout // all timeout configs
 
+	SendQueue *SendQueue // buffer messages when connection is not ready, nil to disable
+
+	Codec          Codec                          // codec for Message.Decode & typed messages, JSONCodec if not set
+	TypeField      string                         // json field of typed envelopes holding the topic, DEFAULT_TYPE_FIELD if not set
+	FramedEnvelope bool                           // frame typed envelopes without the codec, for codecs not producing json
+	OnDecodeError  func(error, *Message, Adapter) // typed messages failed to decode will be reported here
+
 	PingInterval int // how often to ping the other side
 
 	MagicKey    []byte // private magic key, default magic key will be used if not set
@@ -93,15 +215,26 @@ func (c *Config) setup() error {
 	if c.EnableStreams && c.MaxStreams == 0 {
 		c.MaxStreams = DEFAULT_MAX_STREAMS
 	}
+	if c.StreamWindow == 0 {
+		c.StreamWindow = DEFAULT_STREAM_WINDOW
+	}
 	if c.MaxStreams > MAX_STREAMS_IN_THEORY {
 		return fmt.Errorf("stream size %d exceed max %d", c.MaxStreams, MAX_STREAMS_IN_THEORY)
 	}
+	for _, bits := range []int{c.ServerMaxWindowBits, c.ClientMaxWindowBits} {
+		if bits != 0 && (bits < minWindowBits || bits > maxWindowBits) {
+			return fmt.Errorf("window bits %d not in range [%d, %d]", bits, minWindowBits, maxWindowBits)
+		}
+	}
 	if c.PrivateMask != nil && (len(c.PrivateMask) == 0 || len(c.PrivateMask)%4 != 0) {
 		return fmt.Errorf("PrivateMask size %d is not multlply of 4", len(c.PrivateMask))
 	}
 	if c.ChunkSize < DEFAULT_CHUNK_SIZE {
 		c.ChunkSize = DEFAULT_CHUNK_SIZE
 	}
+	if c.PullBuffer == 0 {
+		c.PullBuffer = DEFAULT_PULL_BUFFER
+	}
 	if c.BufferSize == 0 {
 		c.BufferSize = DEFAULT_BUFFER_SIZE
 	}
@@ -112,6 +245,15 @@ func (c *Config) setup() error {
 			CloseTimeout:     DEFAULT_TIMEOUT,
 		}
 	}
+	if c.SendQueue != nil && c.SendQueue.Size <= 0 {
+		return fmt.Errorf("send queue size %d is invalid", c.SendQueue.Size)
+	}
+	if c.Codec == nil {
+		c.Codec = JSONCodec{}
+	}
+	if c.TypeField == "" {
+		c.TypeField = DEFAULT_TYPE_FIELD
+	}
 	if c.PingInterval == 0 {
 		c.PingInterval = DEFAULT_TIMEOUT
 	}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -34,40 +35,73 @@ type EventHandler interface {
 
 type Connection struct {
 	rawConnection net.Conn
+	request       *http.Request // upgrade request for server side
 
 	pendingStreams map[int]*Message
 	inUseStreams   map[int]struct{}
 	lastStream     int
 	streamIdLock   sync.Mutex
+	priorities     map[MessageType]int // priorities of streamed msgs by type
+	flow           *streamFlow         // per stream flow control, nil if disabled
+	scheduler      frameScheduler      // decides the next streamed frame to write
+	sessions       *streamSessions     // opened & accepted Streams, nil if not streamable
 
 	isClient   bool
 	status     Status
 	startClose bool
 	closed     bool
-	started    bool
+	started    bool // read loop is running
 	lastPing   time.Time
 	lastPong   time.Time
+	readyAt    time.Time
 	statusLock sync.Mutex
-	writeLock  sync.Mutex
+	writeLock  sync.Mutex // held by one frame, or one whole msg except MessageWriter
+	msgLock    sync.Mutex // held by the data msg being written without streams, control frames only take writeLock
 
 	config *Config
 	client *ClientConfig
 	node   *NodeConfig
 	negoSet
 
+	// compress context for context takeover
+	deflater *compressor
+	inflater *decompressor
+
+	frames           *frameReader  // frames reading of the serving connection
+	pulled           chan *Message // data msgs for ReadMessage, nil if pulling is not enabled
+	unpulled         chan *Message // closed queue with msgs left after the read loop stops
+	readErr          error         // why the read loop stopped, for ReadMessage
+	queue            *sendQueue    // buffered sends before ready
+	closing          chan struct{} // closed once this side starts to close
+	reconnectHandler func(int, Adapter)
+
+	router     *typedRouter // router for OnTyped, applied on demand
+	routerOnce sync.Once
+
 	// event map as default action, can be replaced.
 	statusEventMap  map[Status]func(Status, Adapter)
 	messageEventMap map[MessageType]func(*Message, Adapter)
+	readerTypes     map[MessageType]struct{} // types bound by OnReader, triggered on first fragment
 	eventPool       []EventHandler
 }
 
-func (con *Connection) prepare() {
+func (con *Connection) prepare() error {
 
 	con.rawConnection.SetDeadline(time.Time{})
+	if e := con.setupCompress(); e != nil {
+		return e
+	}
+	con.setupFlow()
+	con.setupSessions()
 
 	con.status = StatusYetReady
+	con.closing = make(chan struct{})
+	if con.config.SendQueue != nil {
+		con.queue = newSendQueue(con.config.SendQueue)
+	}
 	con.statusEventMap = make(map[Status]func(Status, Adapter))
 	con.messageEventMap = make(map[MessageType]func(*Message, Adapter))
+	con.readerTypes = make(map[MessageType]struct{})
 
 	// if not streamable, pendingStreams is for continue frames
 	con.pendingStreams = make(map[int]*Message)
@@ -85,8 +119,11 @@ func (con *Connection) prepare() {
 	if con.config.PingInterval > 0 {
 		go con.KeepPing(con.config.PingInterval, con.config.Timeout.PongTimeout)
 	}
+	return nil
 }
 
+// Group is the initial group given by NodeConfig, it's not changed by Pool.Join & Pool.Leave,
+// use Pool.GroupsOf for the current groups
 func (con *Connection) Group() string {
 	if con.node == nil {
 		return ""
@@ -94,6 +131,16 @@ func (con *Connection) Group() string {
 	return con.node.Group
 }
 
+// Request is the verified upgrade request, only available for server side
+func (con *Connection) Request() *http.Request {
+	return con.request
+}
+
+// Subprotocol is the negotiated subprotocol, "" if there's none
+func (con *Connection) Subprotocol() string {
+	return con.subprotocol
+}
+
 func (con *Connection) Name() string {
 	if con.node == nil {
 		return ""
@@ -102,13 +149,24 @@ func (con *Connection) Name() string {
 }
 
 func (con *Connection) cleanClose() {
+	con.statusLock.Lock()
 	con.closed = true
+	con.statusLock.Unlock()
 	con.rawConnection.Close()
+	if con.flow != nil {
+		con.flow.close()
+	}
+	if con.sessions != nil {
+		con.sessions.close()
+	}
 	// clear pending received streams
 	for _, m := range con.pendingStreams {
 		if !m.isComplete && m.receive.poolReading {
 			close(m.receive.msgPool)
 		}
+		if !m.isComplete {
+			m.lose()
+		}
 	}
 }
 
@@ -121,10 +179,29 @@ func (con *Connection) Close() {
 	con.CloseWithCode(&CloseCode{NormalClosure, ""})
 }
 
+// closeStuck closes the connection whose writing is stuck, like a slow consumer of pool.
+// The stuck writing holds the write lock, it's failed by an expired write deadline first,
+// then the close frame is sent with a short deadline before closing the underlying connection.
+// The close frame is best effort, it's broken for the other side if the stuck frame is partly written.
+func (con *Connection) closeStuck(c *CloseCode) {
+	con.rawConnection.SetWriteDeadline(time.Now())
+	con.writeLock.Lock()
+	con.rawConnection.SetWriteDeadline(time.Now().Add(stuck_close_timeout))
+	closeMsg := &Message{Type: CloseMessage, payload: c.toBytes()}
+	if con.patchMsg(closeMsg) == nil {
+		closeMsg.isFirst, closeMsg.isComplete = true, true
+		con.writeSingleFrame(closeMsg)
+	}
+	con.writeLock.Unlock()
+	con.closeUpdate()
+	con.cleanClose()
+}
+
 func (con *Connection) closeUpdate() {
 	con.statusLock.Lock()
 	if !con.startClose {
 		con.startClose = true
+		close(con.closing)
 		go con.makeSureClose()
 	}
 	con.statusLock.Unlock()
@@ -133,15 +210,21 @@ func (con *Connection) closeUpdate() {
 
 func (con *Connection) makeSureClose() {
 	time.Sleep(time.Duration(con.config.Timeout.CloseTimeout) * time.Second)
-	if con.closed {
+	if con.isClosed() {
 		return
 	}
 	con.cleanClose()
 }
 
+// ReStart negotiate again with the server using the same dialer, then Start.
+// It only works for client connection after it's closed.
 func (con *Connection) ReStart() error {
-	// reset config
-	negotiate(con.client, con.config)
+	if con.client == nil {
+		return errors.New("only client can restart")
+	}
+	if e := con.renegotiate(false); e != nil {
+		return e
+	}
 	return con.Start()
 }
 
@@ -184,13 +267,35 @@ func (con *Connection) KeepPing(pingInterval, pongTimeout int) {
 }
 
 func (con *Connection) Dispatch(t MessageType, p []byte) error {
+	if con.queue != nil && !(&Message{Type: t}).IsControl() {
+		if queued, e := con.queue.offer(con, t, p); queued {
+			return e
+		}
+	}
+	return con.dispatch(t, p)
+}
+
+func (con *Connection) dispatch(t MessageType, p []byte) error {
 	m := &Message{Type: t, payload: p}
 	if e := con.patchMsg(m); e != nil {
 		return e
 	}
 	if !con.streamable {
-		con.writeLock.Lock()
-		defer con.writeLock.Unlock()
+		defer con.lockWrite(t)()
+	}
+	if m.send.doCompress {
+		// compress context should not move forward if msg can't be sent
+		if e := con.writable(); e != nil {
+			return e
+		}
+		// compress as a whole message before split
+		c, e := con.compressorFor()
+		if e != nil {
+			return e
+		}
+		if m.payload, e = c.compress(m.payload, true); e != nil {
+			return e
+		}
 	}
 
 	for _, msg := range m.split(con.config.ChunkSize) {
@@ -201,23 +306,51 @@ func (con *Connection) Dispatch(t MessageType, p []byte) error {
 	return nil
 }
 
-func (con *Connection) DispatchReader(t MessageType, r io.Reader) (e error) {
+func (con *Connection) DispatchReader(t MessageType, r io.Reader) error {
+	return con.dispatchReader(t, r, nil)
+}
+
+// DispatchReaderWithPriority works like DispatchReader, frames are written with the priority instead of the one of the type.
+// Priority only works on streamable connection.
+func (con *Connection) DispatchReaderWithPriority(t MessageType, r io.Reader, priority int) error {
+	return con.dispatchReader(t, r, &priority)
+}
+
+func (con *Connection) dispatchReader(t MessageType, r io.Reader, priority *int) (e error) {
 	msg := &Message{
 		Type: t,
 	}
 	con.patchMsg(msg)
+	if priority != nil {
+		msg.send.priority = *priority
+	}
 	if !con.streamable {
 		// only lock when it's not streaming, or dead lock may occur
-		con.writeLock.Lock()
-		defer con.writeLock.Unlock()
+		defer con.lockWrite(t)()
+	}
+	var c *compressor
+	if msg.send.doCompress {
+		if c, e = con.compressorFor(); e != nil {
+			return e
+		}
 	}
 	chunkSize := con.config.ChunkSize
 	var vessel = make([]byte, chunkSize)
+	isFirst := true
 	for {
 		n, e := r.Read(vessel)
 		stream := msg.spawnVessel()
 		stream.payload = vessel[0:n]
-
+		stream.isFirst = isFirst
+		isFirst = false
+
+		if c != nil && (e == nil || e == io.EOF) {
+			// chunks are compressed in one deflate stream
+			var ec error
+			if stream.payload, ec = c.compress(stream.payload, e == io.EOF); ec != nil {
+				return ec
+			}
+		}
 		if e != nil {
 			if e == io.EOF {
 				stream.isComplete = true
@@ -239,13 +372,14 @@ func (con *Connection) DispatchReader(t MessageType, r io.Reader) (e error) {
 // patchMsg keeps write Message intact & correct
 func (con *Connection) patchMsg(m *Message) error {
 	m.send = &msgSendOptions{
-		doCompress:    con.compressable && !m.IsControl(),
+		doCompress:    con.compressable && !con.deflateDisabled && !m.IsControl(),
 		compressLevel: con.compressLevel,
 		doMask:        con.isClient,
 		streamlize:    con.streamable && !m.IsControl(),
 	}
 	m.config = &msgConfig{
 		negotiate:      &con.negoSet,
+		inflater:       con.inflater,
 		extraMask:      con.config.PrivateMask,
 		triggerOnStart: con.config.TriggerOnStart,
 	}
@@ -270,30 +404,63 @@ func (con *Connection) patchMsg(m *Message) error {
 		}
 
 		m.send.streamId = con.lastStream
+		m.send.priority = con.priorities[m.Type]
 		con.streamIdLock.Unlock()
+		if con.flow != nil {
+			con.flow.open(m.send.streamId)
+		}
 	}
 	return nil
 }
 
-func (con *Connection) writeSingleFrame(m *Message) error {
-	status := con.status
+// lockWrite holds the connection to write a whole msg of the type without streams, call the returned unlock after that.
+// Data msgs hold msgLock as well, so that control frames can be sent between fragments
+// of the msg written by MessageWriter (RFC6455 5.4), while data msgs won't interleave.
+func (con *Connection) lockWrite(t MessageType) (unlock func()) {
+	data := !(&Message{Type: t}).IsControl()
+	if data {
+		con.msgLock.Lock()
+	}
+	con.writeLock.Lock()
+	return func() {
+		con.writeLock.Unlock()
+		if data {
+			con.msgLock.Unlock()
+		}
+	}
+}
+
+func (con *Connection) writable() error {
+	status := con.currentStatus()
 	if status == StatusClosed {
 		return WriteAfterClose{}
 	}
 	if status != StatusReady {
 		return CantWriteYet{status}
 	}
+	return nil
+}
+
+func (con *Connection) writeSingleFrame(m *Message) error {
+	if e := con.writable(); e != nil {
+		return e
+	}
 	if e := m.assemble(); e != nil {
 		return e
 	}
 	if m.send.streamlize {
+		if con.flow != nil && !m.send.cancelStream {
+			if e := con.flow.acquire(m.send.streamId, len(m.payload)); e != nil {
+				return e
+			}
+		}
+		con.scheduler.acquire(m.send.priority)
+		defer con.scheduler.release()
 		// only lock when it's streaming, or dead lock may occur
 		con.writeLock.Lock()
 		defer con.writeLock.Unlock()
-		if m.isComplete {
-			con.streamIdLock.Lock()
-			delete(con.inUseStreams, m.send.streamId)
-			con.streamIdLock.Unlock()
+		if m.isComplete || m.send.cancelStream {
+			con.releaseStream(m.send.streamId)
 		}
 	}
 	_, e := io.Copy(con.rawConnection, &m.entity)
@@ -333,6 +500,33 @@ func (con *Connection) OnStatus(s Status, action func(Status, Adapter)) {
 
 func (con *Connection) OnMessage(t MessageType, action func(*Message, Adapter)) {
 	con.messageEventMap[t] = action
+	delete(con.readerTypes, t)
+}
+
+// OnReader binds action streaming msgs of the type, it replaces the OnMessage callback of the type.
+// It's triggered on the first fragment no matter Config.TriggerOnStart, payload is read from the connection
+// as the reader goes, see Message.Reader. Frames left are dropped after the action returns.
+// Applied EventHandlers see these msgs on the first fragment too, Read returns MsgYetComplete for them.
+func (con *Connection) OnReader(t MessageType, action func(io.Reader, Adapter)) {
+	con.messageEventMap[t] = func(m *Message, a Adapter) {
+		r := m.Reader()
+		defer r.Close()
+		action(r, a)
+	}
+	con.readerTypes[t] = struct{}{}
+}
+
+// isClosed tells if the underlying connection is closed
+func (con *Connection) isClosed() bool {
+	con.statusLock.Lock()
+	defer con.statusLock.Unlock()
+	return con.closed
+}
+
+func (con *Connection) currentStatus() Status {
+	con.statusLock.Lock()
+	defer con.statusLock.Unlock()
+	return con.status
 }
 
 func (con *Connection) updateStatus(s Status) {
@@ -346,6 +540,18 @@ func (con *Connection) updateStatus(s Status) {
 		return
 	}
 	con.status = s
+	if s == StatusReady && prevStatus != StatusTimeout {
+		// recovery from timeout is not a new connection
+		con.readyAt = time.Now()
+	}
+	if con.queue != nil {
+		// queue reads status while holding its lock, don't take its lock here
+		if s == StatusReady {
+			go con.queue.flush(con)
+		} else if !queueable(s) {
+			go con.queue.wake()
+		}
+	}
 	if action, ok := con.statusEventMap[s]; ok {
 		go action(prevStatus, con)
 	}
@@ -371,119 +577,235 @@ func (con *Connection) triggerMessage(m *Message) {
 			go handler.OnMessage(m, con)
 		}
 	}
+	if _, ok := con.messageEventMap[m.Type]; !ok && (m.Type == TextMessage || m.Type == BinaryMessage) {
+		con.pull(m)
+	}
 }
 
+// Start reading from the connection, it blocks until connection is closed.
+// Client with Reconnect policy will keep reconnecting until it's closed by this side or attempts are used up.
 func (con *Connection) Start() error {
+	con.statusLock.Lock()
+	if con.started {
+		con.statusLock.Unlock()
+		return errors.New("connection is started already")
+	}
+	con.started = true
+	con.statusLock.Unlock()
+	return con.run()
+}
+
+func (con *Connection) run() (e error) {
 	defer func() {
-		con.updateStatus(StatusClosed)
+		con.stopPulling(e)
+	}()
+	e = con.serve()
+	for con.willReconnect() {
+		if e = con.reconnect(); e != nil {
+			return e
+		}
+		e = con.serve()
+	}
+	return e
+}
+
+func (con *Connection) serve() error {
+	defer func() {
+		if con.willReconnect() {
+			con.updateStatus(StatusReconnecting)
+		} else {
+			con.updateStatus(StatusClosed)
+		}
 		con.cleanClose()
 	}()
 
-	reader := bufio.NewReaderSize(con.rawConnection, con.config.BufferSize)
+	con.frames = &frameReader{
+		reader:  bufio.NewReaderSize(con.rawConnection, con.config.BufferSize),
+		vessel2: make([]byte, 2),
+		vessel4: make([]byte, 4),
+		vessel8: make([]byte, 8),
+	}
 	con.updateStatus(StatusReady)
 
-	triggerOnStart := con.config.TriggerOnStart
-	var vessel2 = make([]byte, 2)
-	var vessel4 = make([]byte, 4)
-	var vessel8 = make([]byte, 8)
-	for {
+	for !con.frames.stopped {
+		con.readFrame()
+	}
+	return con.frames.err
+}
+
+// readFrame reads & handles one frame, frames will stop after a failure or the close message
+func (con *Connection) readFrame() {
+	if stop, e := con.nextFrame(); stop || e != nil {
+		con.frames.stopped = true
+		con.frames.err = e
+	}
+}
+
+// pullFrame reads the next frame for msg reader in synchronized handler
+func (con *Connection) pullFrame() error {
+	if !con.frames.stopped {
+		con.readFrame()
+	}
+	if con.frames.stopped {
+		if con.frames.err != nil {
+			return con.frames.err
+		}
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// nextFrame reads one frame, stop is true when close message is received
+func (con *Connection) nextFrame() (stop bool, err error) {
+	reader, vessel2, vessel4, vessel8 := con.frames.reader, con.frames.vessel2, con.frames.vessel4, con.frames.vessel8
+	if s, e := reader.Read(vessel2); e != nil || s != 2 {
+		return true, exceptEOF(e)
+	}
+	msg := &Message{
+		config: &msgConfig{
+			negotiate:      &con.negoSet,
+			inflater:       con.inflater,
+			codec:          con.config.Codec,
+			extraMask:      con.config.PrivateMask,
+			triggerOnStart: con.config.TriggerOnStart,
+			synchronized:   con.config.Synchronize,
+			pullFrame:      con.pullFrame,
+			flow:           con.flow,
+		},
+		receive: &msgReceivedStatus{
+			CreatedAt:    time.Now(),
+			isFromClient: !con.isClient,
+		},
+	}
+	if closeCode := msg.parseMeta(vessel2); closeCode != nil {
+		con.CloseWithCode(closeCode)
+		return false, errors.New("malformed meta")
+	}
+	if !msg.isComplete {
+		msg.receive.done = make(chan struct{})
+	}
+	if msg.receive.size == 126 {
 		if s, e := reader.Read(vessel2); e != nil || s != 2 {
-			return exceptEOF(e)
-		}
-		msg := &Message{
-			config: &msgConfig{
-				negotiate:      &con.negoSet,
-				extraMask:      con.config.PrivateMask,
-				triggerOnStart: triggerOnStart,
-				synchronized:   con.config.Synchronize,
-			},
-			receive: &msgReceivedStatus{
-				CreatedAt:    time.Now(),
-				isFromClient: !con.isClient,
-			},
-		}
-		if closeCode := msg.parseMeta(vessel2); closeCode != nil {
-			con.CloseWithCode(closeCode)
-			return errors.New("malformed meta")
-		}
-		if msg.receive.size == 126 {
-			if s, e := reader.Read(vessel2); e != nil || s != 2 {
-				return errors.New("msg size not given")
-			}
-			msg.receive.size = int64(binary.BigEndian.Uint16(vessel2))
-		} else if msg.receive.size == 127 {
-			if s, e := reader.Read(vessel8); e != nil || s != 8 {
-				return errors.New("msg size not given")
-			}
-			msg.receive.size = int64(binary.BigEndian.Uint64(vessel8))
+			return false, errors.New("msg size not given")
+		}
+		msg.receive.size = int64(binary.BigEndian.Uint16(vessel2))
+	} else if msg.receive.size == 127 {
+		if s, e := reader.Read(vessel8); e != nil || s != 8 {
+			return false, errors.New("msg size not given")
 		}
+		msg.receive.size = int64(binary.BigEndian.Uint64(vessel8))
+	}
 
+	if msg.receive.masked {
+		if s, e := reader.Read(vessel4); e != nil || s != 4 {
+			return false, errors.New("mask key not given")
+		}
+		msg.setMask(vessel4)
+	}
+
+	if msg.receive.size > 0 {
+		if con.config.MaxPayloadSize != 0 && msg.receive.size > int64(con.config.MaxPayloadSize) {
+			return false, MsgTooLarge{}
+		}
+		payload, e := reader.Peek(int(msg.receive.size))
+		if e != nil {
+			return true, exceptEOF(e)
+		}
+		reader.Discard(len(payload))
 		if msg.receive.masked {
-			if s, e := reader.Read(vessel4); e != nil || s != 4 {
-				return errors.New("mask key not given")
+			msg.maskPayload(payload)
+		}
+		if msg.receive.isStream {
+			cancel := payload[0]&0b1000_0000 != 0
+			payload[0] = payload[0] & 0b0111_1111
+			msg.receive.streamId = int(binary.BigEndian.Uint16(payload[:streamBytes]))
+			if msg.receive.streamId == 0 {
+				return false, errors.New("invalid stream id")
+			}
+			if cancel {
+				// the cancel frame ends the stream, nothing more to do with it
+				if con.flow != nil {
+					con.flow.finish(msg.receive.streamId)
+				}
+				if pending, exist := con.pendingStreams[msg.receive.streamId]; exist {
+					pending.cancel()
+					delete(con.pendingStreams, msg.receive.streamId)
+				}
+				return false, nil
 			}
-			msg.setMask(vessel4)
+			payload = payload[streamBytes:]
 		}
+		if _, e := msg.entity.Write(payload); e != nil {
+			return false, e
+		}
+	}
 
-		if msg.receive.size > 0 {
-			if con.config.MaxPayloadSize != 0 && msg.receive.size > int64(con.config.MaxPayloadSize) {
-				return MsgTooLarge{}
+	if msg.Type == WindowUpdateMessage && con.flow != nil {
+		con.flow.update(msg.entity.Bytes())
+		return false, nil
+	}
+	if msg.IsControl() {
+		con.triggerMessage(msg)
+		if msg.Type == CloseMessage {
+			// close ack message will be sent in defer function
+			return true, nil
+		}
+	} else {
+		// no matter streaming or not
+		streamId := msg.receive.streamId
+		// frames kept in msg are granted at once, streamed ones are granted by the reader
+		granted := con.flow != nil && msg.receive.isStream && !msg.isComplete
+		size := msg.entity.Len()
+		if con.flow != nil && msg.receive.isStream {
+			_, exist := con.pendingStreams[streamId]
+			if !con.flow.consume(streamId, size, !exist, msg.isComplete) {
+				con.CloseWithCode(&CloseCode{PolicyViolation, "stream window overdrawn"})
+				return false, errors.New("stream window overdrawn")
 			}
-			payload, e := reader.Peek(int(msg.receive.size))
+		}
+		if pending, exist := con.pendingStreams[streamId]; exist {
+			// try to complete msg
+			// complete msg will be decompressed in merge if necessary
+			streamed, e := pending.merge(msg)
 			if e != nil {
-				return exceptEOF(e)
+				return false, e
 			}
-			reader.Discard(len(payload))
-			if msg.receive.masked {
-				msg.maskPayload(payload)
+			if granted && !streamed {
+				con.flow.grant(streamId, &pending.receive.credit, size)
 			}
-			if msg.receive.isStream {
-				cancel := payload[0]&0b1000_0000 != 0
-				payload[0] = payload[0] & 0b0111_1111
-				msg.receive.streamId = int(binary.BigEndian.Uint16(payload[:streamBytes]))
-				if msg.receive.streamId == 0 {
-					return errors.New("invalid stream id")
-				}
-				if cancel {
-					delete(con.pendingStreams, msg.receive.streamId)
+			if msg.isComplete {
+				if !pending.config.triggerOnStart && !pending.receive.session {
+					con.triggerMessage(pending)
 				}
-				payload = payload[streamBytes:]
-			}
-			if _, e := msg.entity.Write(payload); e != nil {
-				return e
+				delete(con.pendingStreams, streamId)
 			}
-		}
-
-		if msg.IsControl() {
-			con.triggerMessage(msg)
-			if msg.Type == CloseMessage {
-				// close ack message will be sent in defer function
-				return nil
+		} else if msg.Type == StreamMessage && con.sessions != nil {
+			if !msg.isComplete {
+				con.pendingStreams[streamId] = msg
+				if granted {
+					con.flow.grant(streamId, &msg.receive.credit, size)
+				}
 			}
+			con.sessions.arrive(msg)
 		} else {
-			// no matter streaming or not
-			streamId := msg.receive.streamId
-			if pending, exist := con.pendingStreams[streamId]; exist {
-				// try to complete msg
-				if e := pending.merge(msg); e != nil {
-					return e
+			if !msg.isComplete {
+				con.pendingStreams[streamId] = msg
+				if granted {
+					con.flow.grant(streamId, &msg.receive.credit, size)
 				}
-				if msg.isComplete {
-					if !triggerOnStart {
-						con.triggerMessage(pending)
-					}
-					delete(con.pendingStreams, streamId)
+				if _, ok := con.readerTypes[msg.Type]; ok {
+					msg.config.triggerOnStart = true
 				}
-			} else {
-				if !msg.isComplete {
-					con.pendingStreams[streamId] = msg
-					if triggerOnStart {
-						con.triggerMessage(msg)
-					}
-				} else {
+				if msg.config.triggerOnStart {
 					con.triggerMessage(msg)
 				}
+			} else {
+				if e := msg.inflate(); e != nil {
+					return false, e
+				}
+				con.triggerMessage(msg)
 			}
 		}
 	}
+	return false, nil
 }
@@ -1,5 +1,7 @@
 package webson
 
+import "time"
+
 const DEFAULT_TIMEOUT = 10
 
 const DEFAULT_MAGIC_KEY = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
@@ -10,11 +12,32 @@ const DEFAULT_BUFFER_SIZE = 5 * 1024
 // 16bits for streams, 1bit for stream cancel, 15bits for stream id
 const MAX_STREAMS_IN_THEORY = 1 << 15
 const DEFAULT_MAX_STREAMS = 1024
+const DEFAULT_STREAM_WINDOW = 64 * 1024
 
 const DEFAULT_COMPRESS_LEVEL = 1
 
+const DEFAULT_TYPE_FIELD = "type"
+
 // related to msg frame structure & stream id conversion
 const streamBytes = 2
 
+// max body size kept in HandshakeError
+const handshakeBodyLimit = 4 * 1024
+
+const DEFAULT_RECONNECT_MIN_DELAY = time.Second
+const DEFAULT_RECONNECT_MAX_DELAY = 30 * time.Second
+const DEFAULT_RECONNECT_FACTOR = 2
+const DEFAULT_RECONNECT_JITTER = 0.2
+
+const DEFAULT_DISCOVER_INTERVAL = 5 * time.Second
+const DEFAULT_DEDUP_SIZE = 4096
+
+const DEFAULT_PULL_BUFFER = 64
+
+const DEFAULT_WRITE_QUEUE = 64
+const DEFAULT_BLOCK_TIMEOUT = time.Second
+const queue_retry_interval = 100 * time.Millisecond
+const stuck_close_timeout = time.Second
+
 const DEFAULT_POOL_WAIT = 5
 const client_retry_interval = 2
@@ -1,6 +1,11 @@
 package webson
 
-import "fmt"
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
 
 type MsgYetComplete struct{}
 
@@ -20,8 +25,128 @@ func (e CantWriteYet) Error() string {
 	return fmt.Sprintf("can't write at status(%d)", e.Status)
 }
 
+type QueueFull struct{}
+
+func (e QueueFull) Error() string {
+	return "send queue is full"
+}
+
+// ConnectionLost is returned when the connection is lost before the response
+type ConnectionLost struct{}
+
+func (e ConnectionLost) Error() string {
+	return "connection lost"
+}
+
+// RPCError is the error returned by the other side rpc handler
+type RPCError struct {
+	Method  string
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc %s: %s", e.Method, e.Message)
+}
+
+// DecodeError is reported when typed message can't be decoded, Topic is "" if framed envelope is broken
+type DecodeError struct {
+	Topic string
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode topic(%s): %s", e.Topic, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// NodeNotFound is the failure when there's no connection with the name in pool
+type NodeNotFound struct {
+	Name string
+}
+
+func (e NodeNotFound) Error() string {
+	return fmt.Sprintf("node %s not found", e.Name)
+}
+
 type WriteAfterClose struct{}
 
 func (e WriteAfterClose) Error() string {
-	return ""
+	return "write after close"
+}
+
+// UpgradeError rejects the upgrade with custom status code & body
+type UpgradeError struct {
+	Code int
+	Body string
+}
+
+func (e *UpgradeError) Error() string {
+	return fmt.Sprintf("upgrade rejected with %d: %s", e.Code, e.Body)
+}
+
+// HandshakeError is returned when server refused the upgrade
+type HandshakeError struct {
+	StatusCode int
+	Reason     string
+	Header     http.Header
+	Body       []byte // at most 4k of the response body
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake refused with %d %s", e.StatusCode, e.Reason)
+}
+
+// RetryAfter parses Retry-After in seconds or http date, 0 if not given
+func (e *HandshakeError) RetryAfter() time.Duration {
+	v := e.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// DialPhase tells which step the client handshake was in
+type DialPhase int
+
+const (
+	PhaseDial         = DialPhase(0) // tcp/tls dialing
+	PhaseWriteRequest = DialPhase(1) // writing upgrade request
+	PhaseReadResponse = DialPhase(2) // reading upgrade response
+)
+
+func (p DialPhase) String() string {
+	switch p {
+	case PhaseDial:
+		return "dial"
+	case PhaseWriteRequest:
+		return "write request"
+	case PhaseReadResponse:
+		return "read response"
+	}
+	return fmt.Sprintf("phase(%d)", int(p))
+}
+
+// DialError is returned when client handshake failed in the given phase
+type DialError struct {
+	Phase DialPhase
+	Err   error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("%s failed: %v", e.Phase, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
 }
@@ -7,10 +7,10 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"sync"
-	"time"
 
 	"github.com/hellflame/webson"
 )
@@ -32,34 +32,21 @@ func main() {
 			msgIdx += 1
 			return msgIdx
 		}
-		// monitor TextMessage process and read it at last
+		// stream TextMessage to file with Reader, it returns when msg is complete
 		ws.OnMessage(webson.TextMessage, func(m *webson.Message, a webson.Adapter) {
-			// be careful, TriggerOnStart only means trigger on start, you need to:
-			// loop read unfinished msg, until it's complete
-			for {
-				msg, e := m.Read()
-				if e != nil {
-					switch e.(type) {
-					case webson.MsgYetComplete:
-						fmt.Println("waiting for completing msg....")
-						time.Sleep(time.Second)
-						continue
-					default:
-						panic(e)
-					}
-				}
+			reader := m.Reader()
+			defer reader.Close()
 
-				saveName := fmt.Sprintf("%d.txt", getMgsId())
-				save, e := os.Create(saveName)
-				if e != nil {
-					panic(e)
-				}
-				save.Write(msg)
-				save.Close()
-
-				fmt.Println("TextMessage is saved", saveName)
-				break // break out the loop after msg is complete
+			saveName := fmt.Sprintf("%d.txt", getMgsId())
+			save, e := os.Create(saveName)
+			if e != nil {
+				panic(e)
+			}
+			defer save.Close()
+			if _, e := io.Copy(save, reader); e != nil {
+				panic(e)
 			}
+			fmt.Println("TextMessage is saved", saveName)
 		})
 
 		// use ReadIter to process msg chunk by chunk
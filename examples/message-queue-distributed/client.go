@@ -4,7 +4,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
@@ -41,8 +40,7 @@ func main() {
 			if input == "" {
 				continue
 			}
-			js, _ := json.Marshal(msg{Topic: topic, Content: input})
-			a.Dispatch(webson.TextMessage, js)
+			webson.DispatchJSON(a, msg{Topic: topic, Content: input})
 		}
 	}
 
@@ -4,7 +4,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
@@ -18,55 +17,36 @@ type msg struct {
 }
 
 func main() {
-	topicPool := webson.NewPool(nil)
-
-	nodePool := webson.NewPool(nil)
 	port := "8000"
+	var peers []string
 	if len(os.Args) > 1 && os.Args[1] != "8000" {
 		// other node
 		// be sure to user other port than 8000
 		port = os.Args[1]
 
-		// connect to the StartNode
-		ws, e := webson.Dial("ws://127.0.0.1:8000/node", nil)
-		if e != nil {
-			panic(e)
+		// connect to the StartNode, or the given nodes
+		peerPorts := []string{"8000"}
+		if len(os.Args) > 2 {
+			peerPorts = os.Args[2:]
+		}
+		for _, p := range peerPorts {
+			peers = append(peers, "ws://127.0.0.1:"+p+"/node")
 		}
-
-		// other node will take BinaryMessage as broadcast messages.
-		ws.OnMessage(webson.BinaryMessage, func(m *webson.Message, a webson.Adapter) {
-			rawClientMsg, _ := m.Read()
-			var clientMsg msg
-			if json.Unmarshal(rawClientMsg, &clientMsg) != nil {
-				return
-			}
-			// broadcast messages to the local topic group.
-			topicPool.ToGroup(clientMsg.Topic, webson.TextMessage, []byte(clientMsg.Content))
-		})
-		ws.OnReady(func(a webson.Adapter) {
-			fmt.Println("connected to the StartNode")
-		})
-		ws.OnStatus(webson.StatusClosed, func(s webson.Status, a webson.Adapter) {
-			fmt.Println("StartNode has disconnected")
-		})
-
-		nodePool.Add(ws, nil)
 	}
 
+	// broadcasts to topic groups will be forwarded to other nodes
+	topicPool := webson.NewClusterPool(nil, &webson.ClusterConfig{
+		NodeID: port,
+		Peers:  peers,
+	})
+	topicPool.Start()
+
 	http.HandleFunc("/node", func(w http.ResponseWriter, r *http.Request) {
-		ws, e := webson.TakeOver(w, r, nil)
-		if e != nil {
-			return
-		}
-		ws.OnReady(func(a webson.Adapter) {
-			fmt.Println("one node has joined")
-		})
-		ws.OnStatus(webson.StatusClosed, func(s webson.Status, a webson.Adapter) {
-			fmt.Println("one node has left")
-		})
-		if e := nodePool.Add(ws, nil); e != nil {
+		if e := topicPool.TakeOverPeer(w, r, nil); e != nil {
 			fmt.Println(e.Error())
+			return
 		}
+		fmt.Println("one node has joined")
 	})
 
 	http.HandleFunc("/topics", func(w http.ResponseWriter, r *http.Request) {
@@ -97,14 +77,12 @@ func main() {
 			return
 		}
 		ws.OnMessage(webson.TextMessage, func(m *webson.Message, a webson.Adapter) {
-			rawClientMsg, _ := m.Read()
 			var clientMsg msg
-			if json.Unmarshal(rawClientMsg, &clientMsg) != nil {
+			if e := m.Decode(&clientMsg); e != nil {
 				fmt.Println("client msg format error")
 				return
 			}
 			topicPool.ToGroup(clientMsg.Topic, webson.TextMessage, []byte(clientMsg.Content))
-			nodePool.Dispatch(webson.BinaryMessage, rawClientMsg) // send msg to other node
 		})
 
 		// don't forget to Start this non-grouped connection
@@ -11,23 +11,22 @@ import (
 )
 
 func main() {
-	var topic string
+	topics := []string{"default"}
 	if len(os.Args) > 1 {
-		topic = os.Args[1]
+		// wildcards like "orders.*" are supported
+		topics = os.Args[1:]
 	}
 
-	ws, e := webson.Dial("ws://127.0.0.1:8000/topics", &webson.DialConfig{
-		ClientConfig: webson.ClientConfig{ExtraHeaders: map[string]string{
-			"topic": topic,
-		}},
-	})
+	ws, e := webson.Dial("ws://127.0.0.1:8000/topics", nil)
 	if e != nil {
 		panic(e)
 	}
 	fmt.Println("waiting for messages......")
-	ws.OnMessage(webson.TextMessage, func(m *webson.Message, a webson.Adapter) {
-		msg, _ := m.Read()
-		fmt.Println("topic message:", string(msg))
+	webson.OnPublished(ws, func(topic string, payload []byte, a webson.Adapter) {
+		fmt.Println("topic message:", topic, string(payload))
+	})
+	ws.OnReady(func(a webson.Adapter) {
+		webson.Subscribe(a, topics...)
 	})
 
 	if e := ws.Start(); e != nil {
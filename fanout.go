@@ -0,0 +1,199 @@
+package webson
+
+import (
+	"sync"
+	"time"
+)
+
+// SlowPolicy decides what to do when a connection's broadcast queue in pool is full
+type SlowPolicy int
+
+const (
+	SlowDrop       = SlowPolicy(0) // drop the msg for this connection
+	SlowDisconnect = SlowPolicy(1) // fail the stuck write, then close with PolicyViolation
+	SlowBlock      = SlowPolicy(2) // wait for room until PoolConfig.BlockTimeout of the broadcast, then drop
+)
+
+// DeliveryReport tells what happened to each connection for a broadcast.
+// Accepted msgs are queued for writing, they can still fail to write later, use Wait to get the final result.
+type DeliveryReport struct {
+	Accepted     []string // connection names whose queue took the msg
+	Dropped      []string // queue is full, msg is dropped
+	Disconnected []string // queue is full, connection is closed by SlowDisconnect
+	Failed       []string // connection is closed, removed or not found
+
+	pending   sync.WaitGroup
+	lock      sync.Mutex
+	delivered int
+	failures  map[string]error
+}
+
+func newDeliveryReport() *DeliveryReport {
+	return &DeliveryReport{failures: make(map[string]error)}
+}
+
+// Wait until all accepted msgs are written or failed
+func (r *DeliveryReport) Wait() *DeliveryReport {
+	r.pending.Wait()
+	return r
+}
+
+// Delivered is the count of msgs written successfully, it's final after Wait
+func (r *DeliveryReport) Delivered() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.delivered
+}
+
+// Failures are errors by connection name, QueueFull for dropped ones, WriteAfterClose, CantWriteYet or I/O errors.
+// Write failures are complete after Wait.
+func (r *DeliveryReport) Failures() map[string]error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := make(map[string]error, len(r.failures))
+	for n, e := range r.failures {
+		result[n] = e
+	}
+	return result
+}
+
+func (r *DeliveryReport) fail(name string, e error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures[name] = e
+}
+
+// done records the result of an accepted msg
+func (r *DeliveryReport) done(name string, e error) {
+	if e != nil {
+		r.fail(name, e)
+	} else {
+		r.lock.Lock()
+		r.delivered += 1
+		r.lock.Unlock()
+	}
+	r.pending.Done()
+}
+
+type fanoutJob struct {
+	pm     *PreparedMessage
+	report *DeliveryReport
+}
+
+// fanoutWriter drains the broadcast queue of one connection, so that slow ones won't block others
+type fanoutWriter struct {
+	c    *Connection
+	pool *Pool
+	jobs chan *fanoutJob
+	stop chan struct{}
+}
+
+func newFanoutWriter(p *Pool, c *Connection, size int) *fanoutWriter {
+	w := &fanoutWriter{
+		c:    c,
+		pool: p,
+		jobs: make(chan *fanoutJob, size),
+		stop: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *fanoutWriter) run() {
+	for {
+		select {
+		case j := <-w.jobs:
+			e := w.c.DispatchPrepared(j.pm)
+			j.report.done(w.c.Name(), e)
+			if e != nil {
+				w.pool.dispatchFailed(e, w.c)
+			}
+		case <-w.stop:
+			w.drain()
+			return
+		}
+	}
+}
+
+// drain fails msgs left in queue after stopped
+func (w *fanoutWriter) drain() {
+	for {
+		select {
+		case j := <-w.jobs:
+			j.report.done(w.c.Name(), WriteAfterClose{})
+		default:
+			return
+		}
+	}
+}
+
+// close stops writing, msgs left in queue are failed
+func (w *fanoutWriter) close() {
+	close(w.stop)
+}
+
+// offer queues the msg according to the policy, the result is recorded to the report.
+// SlowBlock waits until deadline, which is shared by all connections of one broadcast.
+func (w *fanoutWriter) offer(pm *PreparedMessage, c *PoolConfig, deadline time.Time, r *DeliveryReport) {
+	name := w.c.Name()
+	if w.c.isClosed() {
+		r.Failed = append(r.Failed, name)
+		r.fail(name, WriteAfterClose{})
+		return
+	}
+	r.pending.Add(1)
+	if w.push(&fanoutJob{pm, r}, c, deadline) {
+		r.Accepted = append(r.Accepted, name)
+		return
+	}
+	r.pending.Done()
+
+	select {
+	case <-w.stop:
+		r.Failed = append(r.Failed, name)
+		r.fail(name, WriteAfterClose{})
+		return
+	default:
+	}
+	r.fail(name, QueueFull{})
+	if c.SlowPolicy == SlowDisconnect {
+		go w.c.closeStuck(&CloseCode{PolicyViolation, "slow consumer"})
+		r.Disconnected = append(r.Disconnected, name)
+		return
+	}
+	r.Dropped = append(r.Dropped, name)
+}
+
+// push the job to queue, false if it's full or writer is stopped
+func (w *fanoutWriter) push(j *fanoutJob, c *PoolConfig, deadline time.Time) (pushed bool) {
+	defer func() {
+		if !pushed {
+			return
+		}
+		select {
+		case <-w.stop:
+			// writer may have drained the queue already
+			w.drain()
+		default:
+		}
+	}()
+	select {
+	case <-w.stop:
+		return false
+	case w.jobs <- j:
+		return true
+	default:
+	}
+	if c.SlowPolicy != SlowBlock {
+		return false
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case w.jobs <- j:
+		return true
+	case <-w.stop:
+	case <-timer.C:
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package webson
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newPipeConnection creates a server side connection, writing blocks until the returned peer reads
+func newPipeConnection(t *testing.T) (*Connection, net.Conn) {
+	raw, peer := net.Pipe()
+	c := &Config{PingInterval: -1}
+	if e := c.setup(); e != nil {
+		t.Fatal(e)
+	}
+	con := &Connection{rawConnection: raw, config: c}
+	if e := con.prepare(); e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return con, peer
+}
+
+func TestSlowConsumer(t *testing.T) {
+	for _, policy := range []SlowPolicy{SlowDrop, SlowDisconnect, SlowBlock} {
+		pool := NewPool(&PoolConfig{WriteQueue: 1, SlowPolicy: policy, BlockTimeout: 50 * time.Millisecond})
+		slow, slowPeer := newPipeConnection(t)
+		fast, fastPeer := newPipeConnection(t)
+		go io.Copy(io.Discard, fastPeer)
+		pool.Add(slow, &NodeConfig{Name: "slow"})
+		pool.Add(fast, &NodeConfig{Name: "fast"})
+		time.Sleep(10 * time.Millisecond)
+
+		// first one blocks the slow writer, second one fills the queue
+		var blocked *DeliveryReport
+		for i := 0; i < 2; i++ {
+			r := pool.Dispatch(TextMessage, []byte("msg"))
+			if len(r.Accepted) != 2 {
+				t.Fatalf("unexpected report %+v", r)
+			}
+			if blocked == nil {
+				blocked = r
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		start := time.Now()
+		r := pool.Dispatch(TextMessage, []byte("msg"))
+		if len(r.Accepted) != 1 || r.Accepted[0] != "fast" {
+			t.Errorf("unexpected report %+v", r)
+		}
+		switch policy {
+		case SlowDrop:
+			if len(r.Dropped) != 1 || time.Since(start) > 20*time.Millisecond {
+				t.Errorf("unexpected report %+v", r)
+			}
+		case SlowDisconnect:
+			if len(r.Disconnected) != 1 {
+				t.Errorf("unexpected report %+v", r)
+			}
+			// the blocked writing fails without the consumer reading
+			done := make(chan struct{})
+			go func() {
+				blocked.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+				if _, ok := blocked.Failures()["slow"]; !ok {
+					t.Errorf("unexpected failures %v", blocked.Failures())
+				}
+			case <-time.After(time.Second):
+				t.Error("slow connection is not closed")
+			}
+			// close frame is sent after the blocked writing
+			slowPeer.SetReadDeadline(time.Now().Add(time.Second))
+			frame := make([]byte, 2+len("slow consumer")+2)
+			if _, e := io.ReadFull(slowPeer, frame); e != nil {
+				t.Fatal(e)
+			}
+			if c := ParseCloseCode(frame[2:]); frame[0] != 0x88 || c == nil || c.Code != PolicyViolation {
+				t.Errorf("unexpected close frame %v", frame)
+			}
+		case SlowBlock:
+			if len(r.Dropped) != 1 || time.Since(start) < 50*time.Millisecond {
+				t.Errorf("unexpected report %+v", r)
+			}
+			// consumer catches up during blocking
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				io.Copy(io.Discard, slowPeer)
+			}()
+			if r := pool.Dispatch(TextMessage, []byte("msg")); len(r.Accepted) != 2 {
+				t.Errorf("unexpected report %+v", r)
+			}
+		}
+		slowPeer.Close()
+		fastPeer.Close()
+	}
+}
+
+func TestSlowBlockTimeout(t *testing.T) {
+	pool := NewPool(&PoolConfig{WriteQueue: 1, SlowPolicy: SlowBlock, BlockTimeout: 50 * time.Millisecond})
+	for _, name := range []string{"a", "b", "c"} {
+		slow, _ := newPipeConnection(t)
+		pool.Add(slow, &NodeConfig{Name: name})
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		pool.Dispatch(TextMessage, []byte("msg"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	// all slow connections share one BlockTimeout
+	start := time.Now()
+	r := pool.Dispatch(TextMessage, []byte("msg"))
+	if len(r.Dropped) != 3 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if cost := time.Since(start); cost < 50*time.Millisecond || cost > 100*time.Millisecond {
+		t.Errorf("unexpected blocking time %s", cost)
+	}
+}
+
+func TestFanoutPayloadCopy(t *testing.T) {
+	pool := NewPool(nil)
+	con, peer := newPipeConnection(t)
+	pool.Add(con, &NodeConfig{Name: "alice"})
+	time.Sleep(10 * time.Millisecond)
+
+	buf := []byte("hello")
+	r := pool.Dispatch(TextMessage, buf)
+	// buffer is reused by the caller after return
+	copy(buf, "XXXXX")
+	frame := make([]byte, 7)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, e := io.ReadFull(peer, frame); e != nil {
+		t.Fatal(e)
+	}
+	if string(frame[2:]) != "hello" {
+		t.Errorf("unexpected payload %q", frame[2:])
+	}
+	if r.Wait().Delivered() != 1 {
+		t.Errorf("unexpected report %+v", r)
+	}
+}
+
+func TestDeliveryReport(t *testing.T) {
+	pool := NewPool(nil)
+	good, goodPeer := newPipeConnection(t)
+	bad, badPeer := newPipeConnection(t)
+	go io.Copy(io.Discard, goodPeer)
+	evicted := make(chan string, 1)
+	pool.OnDispatchError(func(e error, a Adapter) {
+		evicted <- a.Name()
+		pool.CastOutByName(a.Name())
+	})
+	pool.Add(good, &NodeConfig{Name: "good"})
+	pool.Add(bad, &NodeConfig{Name: "bad"})
+	time.Sleep(10 * time.Millisecond)
+
+	// writing to bad will fail, but it's not closed yet
+	bad.rawConnection.SetWriteDeadline(time.Now())
+	r := pool.Dispatch(TextMessage, []byte("msg")).Wait()
+	if len(r.Accepted) != 2 || r.Delivered() != 1 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if e, ok := r.Failures()["bad"]; !ok || e == nil {
+		t.Errorf("unexpected failures %v", r.Failures())
+	}
+	select {
+	case name := <-evicted:
+		if name != "bad" {
+			t.Errorf("unexpected evicted %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Error("dispatch error not reported")
+	}
+
+	r = pool.ToPick("bad", TextMessage, []byte("msg"))
+	if _, ok := r.Failures()["bad"].(NodeNotFound); !ok {
+		t.Errorf("unexpected failures %v", r.Failures())
+	}
+	if r := pool.ToPick("good", TextMessage, []byte("msg")).Wait(); r.Delivered() != 1 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	badPeer.Close()
+}
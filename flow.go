@@ -0,0 +1,223 @@
+package webson
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// WindowUpdateMessage is the control message granting more window to a stream, only used with streams.
+// Payload is 2 bytes stream id & 4 bytes increment.
+//
+// Opcode 0xB is reserved for further control frames by RFC6455, other implementations will fail the connection with it.
+// It's only tolerable because it's sent after both sides negotiated a stream window in the handshake,
+// so the other side is known to be webson.
+const WindowUpdateMessage = MessageType(11)
+
+// streamFlow is the per stream flow control of a streamable connection.
+// Every stream can only send as much as the other side granted, it waits for window updates after that,
+// so one slow stream won't block the read loop & other streams on the other side.
+type streamFlow struct {
+	con        *Connection
+	sendWindow int // initial window of every stream granted by other side
+	recvWindow int // initial window of every stream granted to other side
+
+	lock        sync.Mutex
+	cond        *sync.Cond
+	windows     map[int]int // send windows of streams in use
+	recvWindows map[int]int // receive windows of streams the other side is sending
+	closed      bool
+}
+
+func (con *Connection) setupFlow() {
+	if con.flow != nil {
+		con.flow.close()
+	}
+	con.flow = nil
+	if con.sendWindow <= 0 || con.recvWindow <= 0 {
+		return
+	}
+	f := &streamFlow{
+		con:         con,
+		sendWindow:  con.sendWindow,
+		recvWindow:  con.recvWindow,
+		windows:     make(map[int]int),
+		recvWindows: make(map[int]int),
+	}
+	f.cond = sync.NewCond(&f.lock)
+	con.flow = f
+}
+
+// open the send window of a new stream
+func (f *streamFlow) open(streamId int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.windows[streamId] = f.sendWindow
+}
+
+// release the stream after the final or cancel frame
+func (f *streamFlow) release(streamId int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.windows, streamId)
+}
+
+// acquire waits until the stream has window, the window can be overdrawn by one frame
+func (f *streamFlow) acquire(streamId, size int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for {
+		if f.closed {
+			return WriteAfterClose{}
+		}
+		window, ok := f.windows[streamId]
+		if !ok || window > 0 {
+			if ok {
+				f.windows[streamId] = window - size
+			}
+			return nil
+		}
+		f.cond.Wait()
+	}
+}
+
+// update the send window by the other side
+func (f *streamFlow) update(payload []byte) {
+	if len(payload) != 6 {
+		return
+	}
+	streamId := int(binary.BigEndian.Uint16(payload[:2]))
+	increment := int(binary.BigEndian.Uint32(payload[2:]))
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if window, ok := f.windows[streamId]; ok {
+		f.windows[streamId] = window + increment
+		f.cond.Broadcast()
+	}
+}
+
+// consume the receive window of the stream by a received frame, the window is opened by the first frame
+// and closed by the final one. Like acquire, a frame can only be sent when the window is not used up,
+// false is returned if the other side overdraws it.
+func (f *streamFlow) consume(streamId, size int, first, last bool) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	window, ok := f.recvWindows[streamId]
+	if first || !ok {
+		window = f.recvWindow
+	}
+	if window <= 0 {
+		return false
+	}
+	if last {
+		delete(f.recvWindows, streamId)
+	} else {
+		f.recvWindows[streamId] = window - size
+	}
+	return true
+}
+
+// finish the receive window of the canceled stream
+func (f *streamFlow) finish(streamId int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.recvWindows, streamId)
+}
+
+// grant consumed bytes of the stream back to the other side, updates are sent after half window is consumed.
+// Nothing is granted after the stream is finished.
+func (f *streamFlow) grant(streamId int, credit *int, consumed int) {
+	*credit += consumed
+	if *credit < f.recvWindow/2 {
+		return
+	}
+	f.lock.Lock()
+	window, ok := f.recvWindows[streamId]
+	if ok {
+		// window is enlarged before the other side knows it
+		f.recvWindows[streamId] = window + *credit
+	}
+	f.lock.Unlock()
+	if !ok {
+		*credit = 0
+		return
+	}
+	payload := make([]byte, 6)
+	binary.BigEndian.PutUint16(payload, uint16(streamId))
+	binary.BigEndian.PutUint32(payload[2:], uint32(*credit))
+	*credit = 0
+	f.con.dispatch(WindowUpdateMessage, payload)
+}
+
+// close wakes up waiting streams after connection is closed
+func (f *streamFlow) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	f.cond.Broadcast()
+}
+
+// frameScheduler decides which stream writes the next frame, higher priority first, FIFO for the same priority.
+// Low priority streams may wait as long as higher ones keep writing.
+type frameScheduler struct {
+	lock    sync.Mutex
+	busy    bool
+	waiting []*frameTurn
+}
+
+type frameTurn struct {
+	priority int
+	ready    chan struct{}
+}
+
+func (s *frameScheduler) acquire(priority int) {
+	s.lock.Lock()
+	if !s.busy {
+		s.busy = true
+		s.lock.Unlock()
+		return
+	}
+	turn := &frameTurn{priority, make(chan struct{})}
+	i := len(s.waiting)
+	for i > 0 && s.waiting[i-1].priority < priority {
+		i -= 1
+	}
+	s.waiting = append(s.waiting, nil)
+	copy(s.waiting[i+1:], s.waiting[i:])
+	s.waiting[i] = turn
+	s.lock.Unlock()
+	<-turn.ready
+}
+
+func (s *frameScheduler) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.waiting) == 0 {
+		s.busy = false
+		return
+	}
+	turn := s.waiting[0]
+	s.waiting = s.waiting[1:]
+	close(turn.ready)
+}
+
+// SetPriority of streamed msgs with the type, frames of higher priority are written first when streams are writing together.
+// Priority is 0 by default, it only works on streamable connection.
+// It's the default of every msg, which can be changed by MessageWriter.SetPriority, Stream.SetPriority or DispatchReaderWithPriority.
+func (con *Connection) SetPriority(t MessageType, priority int) {
+	con.streamIdLock.Lock()
+	defer con.streamIdLock.Unlock()
+	if con.priorities == nil {
+		con.priorities = make(map[MessageType]int)
+	}
+	con.priorities[t] = priority
+}
+
+// releaseStream after the final or cancel frame is sent
+func (con *Connection) releaseStream(streamId int) {
+	if con.flow != nil {
+		con.flow.release(streamId)
+	}
+	con.streamIdLock.Lock()
+	delete(con.inUseStreams, streamId)
+	con.streamIdLock.Unlock()
+}
@@ -0,0 +1,266 @@
+package webson
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamFlowControl(t *testing.T) {
+	release := make(chan struct{})
+	texts := make(chan string, 10)
+	bins := make(chan []byte, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, &Config{EnableStreams: true, TriggerOnStart: true, StreamWindow: 16 * 1024})
+		if e != nil {
+			return
+		}
+		ws.OnMessage(BinaryMessage, func(m *Message, a Adapter) {
+			reader := m.Reader()
+			defer reader.Close()
+			// slow consumer
+			<-release
+			payload, _ := io.ReadAll(reader)
+			bins <- payload
+		})
+		ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+			if !m.IsComplete() {
+				// only wait for the first fragment
+				return
+			}
+			msg, _ := m.Read()
+			texts <- string(msg)
+		})
+		ws.Start()
+	}))
+	defer s.Close()
+
+	ws, e := Dial(s.URL, &DialConfig{Config: Config{EnableStreams: true}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if ws.flow == nil || ws.flow.sendWindow != 16*1024 || ws.flow.recvWindow != DEFAULT_STREAM_WINDOW {
+		t.Fatalf("unexpected flow %+v", ws.flow)
+	}
+	large := bytes.Repeat([]byte("webson"), 200*1024)
+	sent := make(chan error, 1)
+	ws.OnReady(func(a Adapter) {
+		go func() {
+			sent <- a.Dispatch(BinaryMessage, large)
+		}()
+		time.Sleep(20 * time.Millisecond)
+		for _, msg := range []string{"1", "2"} {
+			a.Dispatch(TextMessage, []byte(msg))
+		}
+	})
+	go ws.Start()
+	defer ws.Close()
+
+	// the slow stream won't block others
+	for range []string{"1", "2"} {
+		select {
+		case msg := <-texts:
+			if msg != "1" && msg != "2" {
+				t.Errorf("unexpected msg %s", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("msg is blocked by the slow stream")
+		}
+	}
+	select {
+	case <-sent:
+		t.Fatal("stream is not limited by window")
+	default:
+	}
+
+	close(release)
+	select {
+	case payload := <-bins:
+		if !bytes.Equal(payload, large) {
+			t.Errorf("unexpected payload %d", len(payload))
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("slow stream is not complete")
+	}
+	if e := <-sent; e != nil {
+		t.Error(e)
+	}
+
+	ws, e = Dial(s.URL, &DialConfig{Config: Config{EnableStreams: true, StreamWindow: -1}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if ws.flow != nil {
+		t.Error("flow control should be disabled")
+	}
+	ws.rawConnection.Close()
+}
+
+func TestStreamWindowOverdraft(t *testing.T) {
+	raw, peer := net.Pipe()
+	defer peer.Close()
+	c := &Config{PingInterval: -1, TriggerOnStart: true, Synchronize: true}
+	if e := c.setup(); e != nil {
+		t.Fatal(e)
+	}
+	con := &Connection{rawConnection: raw, config: c}
+	con.streamable, con.sendWindow, con.recvWindow = true, 1024, 1024
+	if e := con.prepare(); e != nil {
+		t.Fatal(e)
+	}
+	// the reader holds the msg without reading, so nothing is granted back
+	var held io.ReadCloser
+	con.OnMessage(BinaryMessage, func(m *Message, a Adapter) {
+		held = m.Reader()
+	})
+	go con.Start()
+
+	closed := make(chan int, 1)
+	go func() {
+		header := make([]byte, 2)
+		for {
+			if _, e := io.ReadFull(peer, header); e != nil {
+				return
+			}
+			payload := make([]byte, header[1]&0b0111_1111)
+			if _, e := io.ReadFull(peer, payload); e != nil {
+				return
+			}
+			if MessageType(header[0]&0b0000_1111) == CloseMessage {
+				closed <- int(binary.BigEndian.Uint16(payload))
+				return
+			}
+		}
+	}()
+	// the window can be overdrawn by one frame, the frame after that is an overdraft
+	for i := 0; i < 4; i++ {
+		frame := &Message{
+			Type:    BinaryMessage,
+			isFirst: i == 0,
+			payload: bytes.Repeat([]byte("x"), 400),
+			config:  &msgConfig{},
+			send:    &msgSendOptions{streamlize: true, streamId: 1, doMask: true},
+		}
+		if e := frame.assemble(); e != nil {
+			t.Fatal(e)
+		}
+		if _, e := peer.Write(frame.entity.Bytes()); e != nil {
+			t.Fatal(e)
+		}
+	}
+	select {
+	case code := <-closed:
+		if code != PolicyViolation {
+			t.Errorf("unexpected close code %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Error("overdraft is not refused")
+	}
+	if held == nil {
+		t.Error("msg is not triggered")
+	}
+}
+
+func TestFrameScheduler(t *testing.T) {
+	var s frameScheduler
+	s.acquire(0)
+
+	var lock sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i, p := range []int{0, 5, 1, 5} {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			s.acquire(p)
+			lock.Lock()
+			order = append(order, p)
+			lock.Unlock()
+			s.release()
+		}(p)
+		// wait until it's queued
+		for queued := 0; queued != i+1; time.Sleep(time.Millisecond) {
+			s.lock.Lock()
+			queued = len(s.waiting)
+			s.lock.Unlock()
+		}
+	}
+	s.release()
+	wg.Wait()
+	if len(order) != 4 || order[0] != 5 || order[1] != 5 || order[2] != 1 || order[3] != 0 {
+		t.Errorf("unexpected order %v", order)
+	}
+}
+
+func TestMessagePriority(t *testing.T) {
+	raw, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+	c := &Config{PingInterval: -1, EnableStreams: true}
+	if e := c.setup(); e != nil {
+		t.Fatal(e)
+	}
+	con := &Connection{rawConnection: raw, config: c}
+	con.streamable, con.maxStreams = true, c.MaxStreams
+	if e := con.prepare(); e != nil {
+		t.Fatal(e)
+	}
+	con.updateStatus(StatusReady)
+	con.SetPriority(TextMessage, 3)
+	con.SetPriority(StreamMessage, 2)
+
+	// priority of the type is the default, it can be changed for each msg
+	w, e := con.NextWriter(TextMessage)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if w.msg.send.priority != 3 {
+		t.Errorf("unexpected default priority %d", w.msg.send.priority)
+	}
+	w.SetPriority(7)
+	if w.msg.send.priority != 7 {
+		t.Errorf("unexpected priority %d", w.msg.send.priority)
+	}
+	w.Close()
+
+	s, e := con.OpenStream()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if s.w.msg.send.priority != 2 {
+		t.Errorf("unexpected default stream priority %d", s.w.msg.send.priority)
+	}
+	s.SetPriority(5)
+	if s.w.msg.send.priority != 5 {
+		t.Errorf("unexpected stream priority %d", s.w.msg.send.priority)
+	}
+
+	// frames wait for the scheduler in priority order
+	con.scheduler.acquire(0)
+	done := make(chan error, 2)
+	go func() { done <- con.DispatchReader(TextMessage, strings.NewReader("default")) }()
+	go func() { done <- con.DispatchReaderWithPriority(TextMessage, strings.NewReader("urgent"), 9) }()
+	for queued := 0; queued != 2; time.Sleep(time.Millisecond) {
+		con.scheduler.lock.Lock()
+		queued = len(con.scheduler.waiting)
+		con.scheduler.lock.Unlock()
+	}
+	con.scheduler.lock.Lock()
+	if p := []int{con.scheduler.waiting[0].priority, con.scheduler.waiting[1].priority}; p[0] != 9 || p[1] != 3 {
+		t.Errorf("unexpected waiting priorities %v", p)
+	}
+	con.scheduler.lock.Unlock()
+	con.scheduler.release()
+	for i := 0; i < 2; i++ {
+		if e := <-done; e != nil {
+			t.Error(e)
+		}
+	}
+}
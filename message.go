@@ -76,6 +76,7 @@ type msgSendOptions struct {
 	streamlize   bool
 	streamId     int
 	cancelStream bool
+	priority     int
 
 	doMask bool
 }
@@ -97,6 +98,15 @@ type msgReceivedStatus struct {
 	poolReading bool
 	msgPool     chan []byte
 
+	reader  *frameChunks // streaming the msg by Reader
+	lost    bool         // connection is closed before the msg is complete
+	pulled  bool         // queued for ReadMessage, frames can't be read by its reader
+	credit  int          // consumed bytes not granted to the stream yet
+	session bool         // read by a Stream, never triggered
+
+	done     chan struct{} // closed once the incomplete msg is complete, canceled or lost
+	finished bool
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -112,6 +122,7 @@ type Message struct {
 	config  *msgConfig
 
 	isComplete bool
+	isFirst    bool // first frame of the message for sending
 	mask       []byte
 
 	// entity is payload buffer when it's receiving, or raw frame data when it's sending
@@ -134,6 +145,95 @@ func (m *Message) IsComplete() bool {
 	return m.isComplete
 }
 
+// IsCanceled tells whether the streaming msg is canceled by the sender, it will never be complete
+func (m *Message) IsCanceled() bool {
+	return m.receive != nil && m.receive.streamCancel
+}
+
+func (m *Message) cancel() {
+	m.receive.updateLock.Lock()
+	defer m.receive.updateLock.Unlock()
+	m.receive.streamCancel = true
+	if m.receive.poolReading {
+		close(m.receive.msgPool)
+	}
+	if m.receive.reader != nil {
+		m.receive.reader.fail(errors.New("stream canceled"))
+	}
+	m.finish()
+}
+
+// lose the incomplete msg when the connection is closed
+func (m *Message) lose() {
+	m.receive.updateLock.Lock()
+	defer m.receive.updateLock.Unlock()
+	m.receive.lost = true
+	if m.receive.reader != nil {
+		m.receive.reader.fail(io.ErrUnexpectedEOF)
+	}
+	m.finish()
+}
+
+// finish wakes up waitComplete, updateLock should be held
+func (m *Message) finish() {
+	if m.receive.done != nil && !m.receive.finished {
+		m.receive.finished = true
+		close(m.receive.done)
+	}
+}
+
+// waitComplete waits until the msg triggered on start is complete, frames are kept in msg meanwhile.
+// Synchronized handler reads frames from connection by itself.
+func (m *Message) waitComplete() error {
+	m.receive.updateLock.Lock()
+	done := m.receive.done
+	m.receive.updateLock.Unlock()
+	if done == nil {
+		return nil
+	}
+	if m.config.synchronized {
+		for {
+			select {
+			case <-done:
+				return m.completed()
+			default:
+			}
+			if e := m.config.pullFrame(); e != nil {
+				return e
+			}
+		}
+	}
+	<-done
+	return m.completed()
+}
+
+// completed tells why the finished msg can't be read as a whole
+func (m *Message) completed() error {
+	m.receive.updateLock.Lock()
+	defer m.receive.updateLock.Unlock()
+	switch {
+	case m.receive.streamCancel:
+		return errors.New("stream canceled")
+	case m.receive.lost:
+		return io.ErrUnexpectedEOF
+	case m.receive.reader != nil || m.receive.poolReading:
+		return errors.New("msg is being read by another reader")
+	}
+	return nil
+}
+
+// readComplete reads the complete payload no matter Config.TriggerOnStart, the msg is waited until it's complete.
+// It's for handlers always working with complete msgs, like RPC, and keeps the msg readable for others.
+func (m *Message) readComplete() ([]byte, error) {
+	if m.receive == nil {
+		return m.Read()
+	}
+	if e := m.waitComplete(); e != nil {
+		return nil, e
+	}
+	return m.payloadBytes()
+}
+
 func (m *Message) IsControl() bool {
 	return int(m.Type) >= 8
 }
@@ -158,26 +258,9 @@ func (m *Message) maskPayload(payload []byte) {
 	}
 }
 
+// assemble the frame, payload should be compressed already if doCompress
 func (m *Message) assemble() error {
 	payload := m.payload
-	if m.send.doCompress {
-		buf := bytes.NewBuffer(nil)
-		w, e := flate.NewWriter(buf, m.send.compressLevel)
-		if e != nil {
-			return e
-		}
-		if _, e := w.Write(payload); e != nil {
-			return e
-		}
-		if e := w.Flush(); e != nil {
-			return e
-		}
-		payload, e = io.ReadAll(buf)
-		if e != nil {
-			return e
-		}
-		payload = payload[:len(payload)-4]
-	}
 	if m.send.streamlize {
 		streamVessel := make([]byte, len(payload)+streamBytes)
 		binary.BigEndian.PutUint16(streamVessel[:streamBytes], uint16(m.send.streamId))
@@ -203,7 +286,8 @@ func (m *Message) assemble() error {
 	if m.isComplete || m.IsControl() {
 		frame[0] |= 0b1000_0000
 	}
-	if m.send.doCompress {
+	if m.send.doCompress && m.isFirst {
+		// rsv1 is only set on the first frame
 		frame[0] |= 0b0100_0000
 	}
 	if m.send.streamlize {
@@ -214,7 +298,6 @@ func (m *Message) assemble() error {
 		frame[1] |= 0b1000_0000
 		instantMask = createMask()
 		m.setMask(instantMask)
-		m.maskPayload(payload)
 	}
 
 	pos := 2
@@ -236,6 +319,10 @@ func (m *Message) assemble() error {
 		pos += 4
 	}
 	copy(frame[pos:], payload)
+	if m.send.doMask {
+		// mask in frame, payload may be owned by the caller
+		m.maskPayload(frame[pos:])
+	}
 	_, e := m.entity.Write(frame)
 	return e
 }
@@ -284,29 +371,71 @@ func (m *Message) parseMeta(raw []byte) *CloseCode {
 	return nil
 }
 
-func (m *Message) merge(more *Message) error {
+// merge the following frame, streamed is true if it's passed to the reader instead of kept in msg
+func (m *Message) merge(more *Message) (streamed bool, err error) {
+	// may block reading from connection
+	m.receive.updateLock.Lock()
+	if r := m.receive.reader; r != nil {
+		m.isComplete = more.isComplete
+		if m.isComplete {
+			m.finish()
+		}
+		m.receive.updateLock.Unlock()
+		r.push(more.entity.Bytes(), more.isComplete)
+		return true, nil
+	}
+	m.receive.updateLock.Unlock()
 	if m.config.triggerOnStart {
-		// may block reading from connection
 		m.receive.updateLock.Lock()
 		defer m.receive.updateLock.Unlock()
 
 		if m.receive.poolReading {
 			moreMsg, e := io.ReadAll(&more.entity)
 			if e != nil {
-				return e
+				return false, e
 			}
 			m.receive.msgPool <- moreMsg
 			if more.isComplete {
 				close(m.receive.msgPool)
+				m.finish()
 			}
-			return nil
+			return false, nil
 		}
 	}
 	m.receive.UpdatedAt = more.receive.CreatedAt
-	m.isComplete = more.isComplete
 	if _, e := io.Copy(&m.entity, &more.entity); e != nil {
+		return false, e
+	}
+	if more.isComplete {
+		if e := m.inflate(); e != nil {
+			return false, e
+		}
+	}
+	m.isComplete = more.isComplete
+	if m.isComplete {
+		if !m.config.triggerOnStart {
+			// updateLock is held already if triggerOnStart
+			m.receive.updateLock.Lock()
+			defer m.receive.updateLock.Unlock()
+		}
+		m.finish()
+	}
+	return false, nil
+}
+
+// inflate decompresses the complete msg at once when other side keeps compress context,
+// so that msgs are decompressed by the order they are received.
+func (m *Message) inflate() error {
+	if !m.receive.compressed || m.config.inflater == nil {
+		return nil
+	}
+	payload, e := m.config.inflater.decompress(m.entity.Bytes())
+	if e != nil {
 		return e
 	}
+	m.entity.Reset()
+	m.entity.Write(payload)
+	m.receive.compressed = false
 	return nil
 }
 
@@ -318,6 +447,7 @@ func (m *Message) split(sizeLimit int) []*Message {
 			send:       m.send,
 			config:     m.config,
 			isComplete: true,
+			isFirst:    true,
 			Type:       m.Type,
 		}}
 	}
@@ -337,6 +467,7 @@ func (m *Message) split(sizeLimit int) []*Message {
 			config: m.config,
 
 			isComplete: i == int(chunks)-1,
+			isFirst:    i == 0,
 
 			Type:    m.Type,
 			payload: m.payload[l:r],
@@ -353,15 +484,23 @@ func (m *Message) Read() ([]byte, error) {
 		if m.config.synchronized {
 			return nil, errors.New("synchronize read with triggerOnStart")
 		}
+		if m.receive.reader != nil {
+			return nil, errors.New("msg is being read by Reader")
+		}
 		if !m.isComplete {
 			return nil, MsgYetComplete{}
 		}
 	}
+	return m.payloadBytes()
+}
+
+// payloadBytes copies the received payload, decompressed if necessary
+func (m *Message) payloadBytes() ([]byte, error) {
+	// msg can be read by multiple handlers, keep the entity intact
 	if m.receive.compressed {
-		m.entity.Write([]byte("\x00\x00\xff\xff\x01\x00\x00\xff\xff"))
-		return io.ReadAll(flate.NewReader(bytes.NewBuffer(m.entity.Bytes())))
+		return io.ReadAll(flate.NewReader(io.MultiReader(bytes.NewReader(m.entity.Bytes()), bytes.NewReader(deflateTail))))
 	}
-	return io.ReadAll(&m.entity)
+	return append([]byte(nil), m.entity.Bytes()...), nil
 }
 
 // ReadIter generate payload chunk by chunk
@@ -375,17 +514,34 @@ func (m *Message) ReadIter(chanSize int) <-chan []byte {
 	m.receive.updateLock.Lock()
 	defer m.receive.updateLock.Unlock()
 
-	m.receive.poolReading = true
-	m.receive.msgPool = make(chan []byte, chanSize)
-
+	msgPool := make(chan []byte, chanSize)
 	var received []byte
 	if m.receive.compressed {
-		m.entity.Write([]byte("\x00\x00\xff\xff\x01\x00\x00\xff\xff"))
+		m.entity.Write(deflateTail)
 		received, _ = io.ReadAll(flate.NewReader(bytes.NewBuffer(m.entity.Bytes())))
 	} else {
 		received, _ = io.ReadAll(&m.entity)
 	}
 
+	if m.config.flow != nil && m.receive.isStream && !m.isComplete && m.receive.reader == nil {
+		// pump chunks to the channel, so that a slow consumer only blocks its own stream
+		chunks := m.chunks(received, nil)
+		m.receive.reader = chunks
+		go func() {
+			defer close(msgPool)
+			for {
+				chunk, e := chunks.next()
+				if e != nil {
+					return
+				}
+				msgPool <- chunk
+			}
+		}()
+		return msgPool
+	}
+
+	m.receive.poolReading = true
+	m.receive.msgPool = msgPool
 	m.receive.msgPool <- received
 	if m.isComplete {
 		close(m.receive.msgPool)
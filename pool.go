@@ -1,6 +1,7 @@
 package webson
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"time"
@@ -38,11 +39,19 @@ type Pool struct {
 	config  *PoolConfig
 
 	entryMap map[string]*Connection
+	groups   map[string]map[string]*Connection // group -> name -> connection
+	joined   map[string]map[string]struct{}    // name -> groups
+	writers  map[string]*fanoutWriter          // name -> broadcast writer
 
 	poolEventProxy
 
 	poolLock sync.Mutex
 	closed   bool
+	empty    chan struct{} // closed once there's no connection in the pool
+
+	removed func(*Connection) // called after connection is removed
+
+	dispatchErrorHandler func(error, Adapter)
 }
 
 // NewPool create a usable connection pool
@@ -53,9 +62,18 @@ func NewPool(c *PoolConfig) *Pool {
 	if c.Name == "" {
 		c.Name = createChallengeKey()
 	}
+	if c.WriteQueue <= 0 {
+		c.WriteQueue = DEFAULT_WRITE_QUEUE
+	}
+	if c.BlockTimeout <= 0 {
+		c.BlockTimeout = DEFAULT_BLOCK_TIMEOUT
+	}
 	return &Pool{
 		config:   c,
 		entryMap: make(map[string]*Connection),
+		groups:   make(map[string]map[string]*Connection),
+		joined:   make(map[string]map[string]struct{}),
+		writers:  make(map[string]*fanoutWriter),
 
 		poolEventProxy: poolEventProxy{name: c.Name},
 	}
@@ -71,6 +89,17 @@ func (p *Pool) OnMessage(action func(*Message, Adapter)) {
 	p.messageHandler = action
 }
 
+// OnDispatchError will bind handler for broadcast write failures, like evicting the failing connection
+func (p *Pool) OnDispatchError(action func(error, Adapter)) {
+	p.dispatchErrorHandler = action
+}
+
+func (p *Pool) dispatchFailed(e error, c *Connection) {
+	if p.dispatchErrorHandler != nil {
+		p.dispatchErrorHandler(e, c)
+	}
+}
+
 // Add takes one connection to the pool, it can be a client or server connection
 func (p *Pool) Add(c *Connection, config *NodeConfig) error {
 	if config == nil {
@@ -84,6 +113,9 @@ func (p *Pool) Add(c *Connection, config *NodeConfig) error {
 	p.poolLock.Lock()
 	defer p.poolLock.Unlock()
 
+	if p.closed {
+		return errors.New("pool is closed")
+	}
 	connectionName := c.node.Name
 	if _, exist := p.entryMap[connectionName]; exist {
 		return errors.New("connection name conflict")
@@ -93,7 +125,18 @@ func (p *Pool) Add(c *Connection, config *NodeConfig) error {
 	}
 
 	c.Apply(&p.poolEventProxy)
+	if len(p.entryMap) == 0 {
+		p.empty = make(chan struct{})
+	}
 	p.entryMap[connectionName] = c
+	p.joined[connectionName] = make(map[string]struct{})
+	p.writers[connectionName] = newFanoutWriter(p, c, p.config.WriteQueue)
+	if config.Group != "" {
+		p.join(c, config.Group)
+	}
+	for _, g := range config.Groups {
+		p.join(c, g)
+	}
 
 	if c.isClient {
 		p.clients = append(p.clients, c)
@@ -107,13 +150,32 @@ func (p *Pool) Add(c *Connection, config *NodeConfig) error {
 }
 
 func (p *Pool) remove(c *Connection) {
+	if p.detach(c) && p.removed != nil {
+		p.removed(c)
+	}
+}
+
+func (p *Pool) detach(c *Connection) bool {
 	name := c.node.Name
 	isClient := c.isClient
 
 	p.poolLock.Lock()
 	defer p.poolLock.Unlock()
 
+	if p.entryMap[name] != c {
+		// removed already
+		return false
+	}
 	delete(p.entryMap, name)
+	if len(p.entryMap) == 0 {
+		close(p.empty)
+	}
+	for g := range p.joined[name] {
+		p.leave(name, g)
+	}
+	delete(p.joined, name)
+	p.writers[name].close()
+	delete(p.writers, name)
 	c.Revoke(p.name)
 
 	idx := -1
@@ -135,22 +197,27 @@ func (p *Pool) remove(c *Connection) {
 			p.servers = append(p.servers[:idx], p.servers[idx+1:]...)
 		}
 	}
+	return true
 }
 
 func (p *Pool) startClient(c *Connection) {
 	retry := p.config.ClientRetry
-	for {
-		c.Start()
-		if retry > 0 && !p.closed {
-			time.Sleep(time.Duration(p.config.RetryInterval) * time.Second)
-			retry -= 1
-		} else {
-			break
-		}
+	c.Start()
+	for retry > 0 && !p.isClosed() {
+		time.Sleep(time.Duration(p.config.RetryInterval) * time.Second)
+		retry -= 1
+		// negotiate again for a new connection
+		c.ReStart()
 	}
 	p.remove(c)
 }
 
+func (p *Pool) isClosed() bool {
+	p.poolLock.Lock()
+	defer p.poolLock.Unlock()
+	return p.closed
+}
+
 func (p *Pool) startServer(c *Connection) {
 	c.Start()
 	p.remove(c)
@@ -174,92 +241,309 @@ func (p *Pool) CastOutByName(name string) bool {
 }
 
 // Dispatch will broadcast the message to all connections in the pool
-func (p *Pool) Dispatch(t MessageType, payload []byte) {
+func (p *Pool) Dispatch(t MessageType, payload []byte) *DeliveryReport {
+	return p.broadcast(t, payload, func(c *Connection) bool {
+		return true
+	})
+}
+
+// ToClients will broadcast the message to client side connections (from Dial)
+func (p *Pool) ToClients(t MessageType, payload []byte) *DeliveryReport {
+	return p.broadcast(t, payload, func(c *Connection) bool {
+		return c.isClient
+	})
+}
+
+// ToServers will broadcast the message to server side connections (from TakeOver)
+func (p *Pool) ToServers(t MessageType, payload []byte) *DeliveryReport {
+	return p.broadcast(t, payload, func(c *Connection) bool {
+		return !c.isClient
+	})
+}
+
+// ToGroup will broadcast the message to the given group connections
+func (p *Pool) ToGroup(gName string, t MessageType, payload []byte) *DeliveryReport {
 	p.poolLock.Lock()
-	defer p.poolLock.Unlock()
+	writers := make([]*fanoutWriter, 0, len(p.groups[gName]))
+	for name := range p.groups[gName] {
+		writers = append(writers, p.writers[name])
+	}
+	p.poolLock.Unlock()
 
-	for _, c := range p.entryMap {
-		c.Dispatch(t, payload)
+	return p.fanout(writers, t, payload)
+}
+
+// broadcast to connections chosen by pick
+func (p *Pool) broadcast(t MessageType, payload []byte, pick func(*Connection) bool) *DeliveryReport {
+	p.poolLock.Lock()
+	writers := make([]*fanoutWriter, 0, len(p.writers))
+	for _, w := range p.writers {
+		if pick(w.c) {
+			writers = append(writers, w)
+		}
+	}
+	p.poolLock.Unlock()
+
+	return p.fanout(writers, t, payload)
+}
+
+// fanout queues the msg to writers without holding the pool lock, slow connections won't block the pool.
+// msg is prepared once for all connections, payload is copied since it's written after return.
+func (p *Pool) fanout(writers []*fanoutWriter, t MessageType, payload []byte) *DeliveryReport {
+	report := newDeliveryReport()
+	job := NewPreparedMessage(t, append([]byte(nil), payload...)) // payload may be reused by the caller
+	// SlowBlock waits at most BlockTimeout for the whole broadcast, not for each connection
+	deadline := time.Now().Add(p.config.BlockTimeout)
+	for _, w := range writers {
+		w.offer(job, p.config, deadline, report)
 	}
+	return report
 }
 
-// ToClients will broadcast the message to client side connections (from Dial)
-func (p *Pool) ToClients(t MessageType, payload []byte) {
+// Join the connection with the given name to the group, a connection can be in any number of groups
+func (p *Pool) Join(name, group string) error {
+	if group == "" {
+		return errors.New("group name is empty")
+	}
 	p.poolLock.Lock()
 	defer p.poolLock.Unlock()
-	for _, c := range p.clients {
-		c.Dispatch(t, payload)
+
+	c, ok := p.entryMap[name]
+	if !ok {
+		return errors.New("connection not found")
 	}
+	p.join(c, group)
+	return nil
 }
 
-// ToServers will broadcast the message to server side connections (from TakeOver)
-func (p *Pool) ToServers(t MessageType, payload []byte) {
+// Leave the group for the connection with the given name, false if it's not in the group
+func (p *Pool) Leave(name, group string) bool {
 	p.poolLock.Lock()
 	defer p.poolLock.Unlock()
-	for _, c := range p.servers {
-		c.Dispatch(t, payload)
+
+	if _, ok := p.joined[name][group]; !ok {
+		return false
 	}
+	p.leave(name, group)
+	return true
 }
 
-// ToClients will broadcast the message to the given group connections
-func (p *Pool) ToGroup(gName string, t MessageType, payload []byte) {
+// GroupsOf the connection with the given name
+func (p *Pool) GroupsOf(name string) []string {
 	p.poolLock.Lock()
 	defer p.poolLock.Unlock()
 
-	for _, c := range p.entryMap {
-		if c.node.Group == gName {
-			c.Dispatch(t, payload)
+	var groups []string
+	for g := range p.joined[name] {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+func (p *Pool) join(c *Connection, group string) {
+	members, ok := p.groups[group]
+	if !ok {
+		members = make(map[string]*Connection)
+		p.groups[group] = members
+	}
+	members[c.node.Name] = c
+	p.joined[c.node.Name][group] = struct{}{}
+}
+
+func (p *Pool) leave(name, group string) {
+	delete(p.joined[name], group)
+	if members, ok := p.groups[group]; ok {
+		delete(members, name)
+		if len(members) == 0 {
+			delete(p.groups, group)
 		}
 	}
 }
 
-// ToPick will try to send message to the connection with given name
-func (p *Pool) ToPick(name string, t MessageType, payload []byte) bool {
+// Get the connection with the given name
+func (p *Pool) Get(name string) (*Connection, bool) {
 	p.poolLock.Lock()
 	defer p.poolLock.Unlock()
+	c, ok := p.entryMap[name]
+	return c, ok
+}
 
-	if c, exist := p.entryMap[name]; exist {
-		c.Dispatch(t, payload)
-		return true
+// Names of all connections in the pool
+func (p *Pool) Names() []string {
+	p.poolLock.Lock()
+	defer p.poolLock.Unlock()
+	names := make([]string, 0, len(p.entryMap))
+	for n := range p.entryMap {
+		names = append(names, n)
 	}
-	return false
+	return names
 }
 
-// Except will broadcast message to all connections except the given name
-func (p *Pool) Except(name string, t MessageType, payload []byte) {
+// Len is the count of connections in the pool
+func (p *Pool) Len() int {
 	p.poolLock.Lock()
 	defer p.poolLock.Unlock()
+	return len(p.entryMap)
+}
 
-	for n, c := range p.entryMap {
-		if n == name {
-			continue
+// Groups are names of all groups with members
+func (p *Pool) Groups() []string {
+	p.poolLock.Lock()
+	defer p.poolLock.Unlock()
+	groups := make([]string, 0, len(p.groups))
+	for g := range p.groups {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// Members are connection names of the group
+func (p *Pool) Members(group string) []string {
+	p.poolLock.Lock()
+	defer p.poolLock.Unlock()
+	names := make([]string, 0, len(p.groups[group]))
+	for n := range p.groups[group] {
+		names = append(names, n)
+	}
+	return names
+}
+
+// Range calls f for every connection until f returns false.
+// Connections are collected before calling, so f can operate the pool.
+func (p *Pool) Range(f func(Adapter) bool) {
+	p.poolLock.Lock()
+	connections := make([]*Connection, 0, len(p.entryMap))
+	for _, c := range p.entryMap {
+		connections = append(connections, c)
+	}
+	p.poolLock.Unlock()
+
+	for _, c := range connections {
+		if !f(c) {
+			return
 		}
-		c.Dispatch(t, payload)
 	}
 }
 
+// Nodes are snapshots of all connections in the pool
+func (p *Pool) Nodes() []NodeInfo {
+	p.poolLock.Lock()
+	defer p.poolLock.Unlock()
+	nodes := make([]NodeInfo, 0, len(p.entryMap))
+	for n, c := range p.entryMap {
+		nodes = append(nodes, p.nodeInfo(n, c))
+	}
+	return nodes
+}
+
+// Node is the snapshot of the connection with the given name
+func (p *Pool) Node(name string) (NodeInfo, bool) {
+	p.poolLock.Lock()
+	defer p.poolLock.Unlock()
+	c, ok := p.entryMap[name]
+	if !ok {
+		return NodeInfo{}, false
+	}
+	return p.nodeInfo(name, c), true
+}
+
+// nodeInfo should be called with pool lock held
+func (p *Pool) nodeInfo(name string, c *Connection) NodeInfo {
+	info := NodeInfo{
+		Name:  name,
+		Role:  RoleServer,
+		Group: c.node.Group,
+	}
+	if c.isClient {
+		info.Role = RoleClient
+	}
+	for g := range p.joined[name] {
+		info.Groups = append(info.Groups, g)
+	}
+	c.statusLock.Lock()
+	info.Status = c.status
+	info.ConnectedSince = c.readyAt
+	c.statusLock.Unlock()
+	return info
+}
+
+// ToPick will try to send message to the connection with given name
+func (p *Pool) ToPick(name string, t MessageType, payload []byte) *DeliveryReport {
+	p.poolLock.Lock()
+	w, exist := p.writers[name]
+	p.poolLock.Unlock()
+
+	if !exist {
+		report := newDeliveryReport()
+		report.Failed = append(report.Failed, name)
+		report.fail(name, NodeNotFound{name})
+		return report
+	}
+	return p.fanout([]*fanoutWriter{w}, t, payload)
+}
+
+// Except will broadcast message to all connections except the given name
+func (p *Pool) Except(name string, t MessageType, payload []byte) *DeliveryReport {
+	return p.broadcast(t, payload, func(c *Connection) bool {
+		return c.node.Name != name
+	})
+}
+
 // Close the pool, return when all connection closed
 func (p *Pool) Close() {
-	p.closed = true
+	p.Shutdown(context.Background())
+}
+
+// Shutdown stops taking new connections, sends PoolConfig.CloseCode to every connection,
+// then waits for their close acks until ctx is done. Connections left will be closed forcibly with ctx.Err() returned.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	code := p.config.CloseCode
+	if code == nil {
+		code = &CloseCode{NormalClosure, ""}
+	}
 	p.poolLock.Lock()
+	p.closed = true
+	connections := make([]*Connection, 0, len(p.entryMap))
 	for _, c := range p.entryMap {
-		c.Close()
+		connections = append(connections, c)
 	}
 	p.poolLock.Unlock()
-	p.Wait()
+
+	for _, c := range connections {
+		go c.CloseWithCode(code)
+	}
+	if e := p.WaitContext(ctx); e != nil {
+		p.poolLock.Lock()
+		for _, c := range p.entryMap {
+			c.rawConnection.Close()
+		}
+		p.poolLock.Unlock()
+		return e
+	}
+	return nil
 }
 
 // Wait will wait until all connection is dead.
+// It returns at once if there's no connection in the pool.
 func (p *Pool) Wait() {
-	for {
-		time.Sleep(time.Duration(client_retry_interval) * time.Second)
+	p.WaitContext(context.Background())
+}
 
+// WaitContext is Wait with a context, ctx.Err() is returned if ctx is done first
+func (p *Pool) WaitContext(ctx context.Context) error {
+	for {
 		p.poolLock.Lock()
-		stop := len(p.entryMap) <= 0 && p.closed
+		if len(p.entryMap) == 0 {
+			p.poolLock.Unlock()
+			return nil
+		}
+		empty := p.empty
 		p.poolLock.Unlock()
 
-		if stop {
-			break
+		select {
+		case <-empty:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
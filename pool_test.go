@@ -0,0 +1,228 @@
+package webson
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPoolServer adds every server connection to the pool, named by query "name"
+// and joined to the comma separated groups in query "groups"
+func newPoolServer(t *testing.T, pool *Pool) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, nil)
+		if e != nil {
+			return
+		}
+		node := &NodeConfig{Name: r.URL.Query().Get("name")}
+		if groups := r.URL.Query().Get("groups"); groups != "" {
+			node.Groups = strings.Split(groups, ",")
+		}
+		if e := pool.Add(ws, node); e != nil {
+			t.Error(e)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// dialReceiver dials the server and collects text messages
+func dialReceiver(t *testing.T, url string) (*Connection, chan string) {
+	ws, e := Dial(url, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	received := make(chan string, 10)
+	ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+		msg, _ := m.Read()
+		received <- string(msg)
+	})
+	go ws.Start()
+	t.Cleanup(ws.Close)
+	return ws, received
+}
+
+func TestPoolGroups(t *testing.T) {
+	pool := NewPool(nil)
+	s := newPoolServer(t, pool)
+	_, alice := dialReceiver(t, s.URL+"/?name=alice&groups=room1,room2")
+	_, bob := dialReceiver(t, s.URL+"/?name=bob&groups=room2")
+	time.Sleep(20 * time.Millisecond)
+
+	expect := func(ch chan string, msgs ...string) {
+		for _, msg := range msgs {
+			select {
+			case got := <-ch:
+				if got != msg {
+					t.Errorf("unexpected msg %s, expect %s", got, msg)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%s not received", msg)
+			}
+		}
+		select {
+		case got := <-ch:
+			t.Errorf("unexpected msg %s", got)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	pool.ToGroup("room1", TextMessage, []byte("1"))
+	expect(alice, "1")
+	expect(bob)
+
+	pool.ToGroup("room2", TextMessage, []byte("2"))
+	expect(alice, "2")
+	expect(bob, "2")
+
+	if e := pool.Join("bob", "room1"); e != nil {
+		t.Fatal(e)
+	}
+	if !pool.Leave("alice", "room1") || pool.Leave("alice", "room1") {
+		t.Error("unexpected leave result")
+	}
+	if info, ok := pool.Node("alice"); !ok || strings.Join(info.Groups, ",") != "room2" {
+		t.Errorf("unexpected groups after leave %v", info.Groups)
+	}
+	pool.ToGroup("room1", TextMessage, []byte("3"))
+	expect(alice)
+	expect(bob, "3")
+
+	groups := pool.GroupsOf("bob")
+	sort.Strings(groups)
+	if strings.Join(groups, ",") != "room1,room2" {
+		t.Errorf("unexpected groups %v", groups)
+	}
+	if pool.Join("nobody", "room1") == nil {
+		t.Error("join should fail for unknown connection")
+	}
+
+	pool.CastOutByName("bob")
+	if len(pool.GroupsOf("bob")) != 0 || len(pool.groups["room1"]) != 0 {
+		t.Error("group index is not cleaned")
+	}
+}
+
+func TestPoolIntrospection(t *testing.T) {
+	pool := NewPool(nil)
+	s := newPoolServer(t, pool)
+	start := time.Now()
+	dialReceiver(t, s.URL+"/?name=alice&groups=room1,room2")
+	dialReceiver(t, s.URL+"/?name=bob&groups=room2")
+	time.Sleep(20 * time.Millisecond)
+
+	if pool.Len() != 2 {
+		t.Errorf("unexpected len %d", pool.Len())
+	}
+	names := pool.Names()
+	sort.Strings(names)
+	if strings.Join(names, ",") != "alice,bob" {
+		t.Errorf("unexpected names %v", names)
+	}
+	groups := pool.Groups()
+	sort.Strings(groups)
+	members := pool.Members("room2")
+	sort.Strings(members)
+	if strings.Join(groups, ",") != "room1,room2" || strings.Join(members, ",") != "alice,bob" {
+		t.Errorf("unexpected groups %v %v", groups, members)
+	}
+	if c, ok := pool.Get("alice"); !ok || c.Name() != "alice" {
+		t.Error("alice not found")
+	}
+	if _, ok := pool.Get("nobody"); ok {
+		t.Error("unexpected connection")
+	}
+
+	visited := 0
+	pool.Range(func(a Adapter) bool {
+		visited += 1
+		return false
+	})
+	if visited != 1 {
+		t.Errorf("range is not stopped, %d", visited)
+	}
+
+	info, ok := pool.Node("bob")
+	if !ok || info.Role != RoleServer || info.Status != StatusReady ||
+		info.ConnectedSince.Before(start) || len(info.Groups) != 1 || info.Groups[0] != "room2" {
+		t.Errorf("unexpected node info %+v", info)
+	}
+	if len(pool.Nodes()) != 2 {
+		t.Errorf("unexpected nodes %+v", pool.Nodes())
+	}
+}
+
+func TestPoolShutdown(t *testing.T) {
+	pool := NewPool(&PoolConfig{CloseCode: &CloseCode{ServiceRestart, "restarting"}})
+	s := newPoolServer(t, pool)
+	codes := make(chan *CloseCode, 2)
+	for _, name := range []string{"alice", "bob"} {
+		// handler is bound before Start
+		ws, e := Dial(s.URL+"/?name="+name, nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+		ws.OnMessage(CloseMessage, func(m *Message, a Adapter) {
+			raw, _ := m.Read()
+			codes <- ParseCloseCode(raw)
+		})
+		go ws.Start()
+		t.Cleanup(ws.Close)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if e := pool.Shutdown(ctx); e != nil {
+		t.Fatal(e)
+	}
+	if time.Since(start) > 500*time.Millisecond || pool.Len() != 0 {
+		t.Errorf("pool is not closed by acks, %s %d", time.Since(start), pool.Len())
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-codes:
+			if c.Code != ServiceRestart || c.Reason != "restarting" {
+				t.Errorf("unexpected close code %+v", c)
+			}
+		case <-time.After(time.Second):
+			t.Error("close code not received")
+		}
+	}
+	if pool.Add(&Connection{}, &NodeConfig{Name: "carol"}) == nil {
+		t.Error("add should fail after shutdown")
+	}
+}
+
+func TestPoolWait(t *testing.T) {
+	pool := NewPool(nil)
+	pool.Wait() // empty pool
+
+	s := newPoolServer(t, pool)
+	ws, _ := dialReceiver(t, s.URL+"/?name=alice")
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if e := pool.WaitContext(ctx); e != context.DeadlineExceeded {
+		t.Errorf("unexpected wait result %v", e)
+	}
+
+	// pool is never closed, wait returns once the connection is gone
+	done := make(chan struct{})
+	go func() {
+		pool.Wait()
+		close(done)
+	}()
+	ws.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("wait is not returned")
+	}
+}
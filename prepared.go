@@ -0,0 +1,141 @@
+package webson
+
+import (
+	"bytes"
+	"sync"
+)
+
+// PreparedMessage caches the encoded frames of one message, so that sending it to many connections
+// won't compress & assemble it again and again.
+// Frames are cached for every combination of compression & chunk size, connections without masking & streaming
+// write the cached bytes directly, others only mask or patch stream id on the cached chunks.
+//
+// Connections keeping compress context (no no_context_takeover) can't share the compressed frames,
+// they compress prepared messages with their own context like Dispatch.
+type PreparedMessage struct {
+	Type    MessageType
+	payload []byte
+
+	lock   sync.Mutex
+	frames map[preparedKey]*preparedFrames
+}
+
+type preparedKey struct {
+	compress  bool
+	level     int
+	chunkSize int
+	assembled bool // frames are assembled without mask & stream id
+}
+
+type preparedFrames struct {
+	chunks [][]byte // payload of every frame, compressed if necessary
+	raw    []byte   // assembled frames
+}
+
+// NewPreparedMessage prepares payload for sending, payload should not be modified after that
+func NewPreparedMessage(t MessageType, payload []byte) *PreparedMessage {
+	return &PreparedMessage{
+		Type:    t,
+		payload: payload,
+		frames:  make(map[preparedKey]*preparedFrames),
+	}
+}
+
+// encode or get the cached frames for the key
+func (pm *PreparedMessage) encode(key preparedKey) (*preparedFrames, error) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if f, ok := pm.frames[key]; ok {
+		return f, nil
+	}
+
+	payload := pm.payload
+	if key.compress {
+		c, e := newCompressor(key.level, false)
+		if e != nil {
+			return nil, e
+		}
+		if payload, e = c.compress(payload, true); e != nil {
+			return nil, e
+		}
+	}
+	msg := &Message{Type: pm.Type, payload: payload}
+	f := &preparedFrames{}
+	for _, m := range msg.split(key.chunkSize) {
+		f.chunks = append(f.chunks, m.payload)
+	}
+	if key.assembled {
+		send := &msgSendOptions{doCompress: key.compress}
+		var raw bytes.Buffer
+		for i, chunk := range f.chunks {
+			m := &Message{
+				send:       send,
+				isFirst:    i == 0,
+				isComplete: i == len(f.chunks)-1,
+				Type:       pm.Type,
+				payload:    chunk,
+			}
+			if e := m.assemble(); e != nil {
+				return nil, e
+			}
+			raw.Write(m.entity.Bytes())
+		}
+		f.raw = raw.Bytes()
+	}
+	pm.frames[key] = f
+	return f, nil
+}
+
+// DispatchPrepared sends the prepared message, frames are encoded once for connections with the same settings.
+func (con *Connection) DispatchPrepared(pm *PreparedMessage) error {
+	if con.queue != nil && !(&Message{Type: pm.Type}).IsControl() {
+		if queued, e := con.queue.offer(con, pm.Type, pm.payload); queued {
+			return e
+		}
+	}
+	m := &Message{Type: pm.Type}
+	if e := con.patchMsg(m); e != nil {
+		return e
+	}
+	if m.send.doCompress && con.deflater != nil {
+		// compress context can't be shared
+		return con.dispatch(pm.Type, pm.payload)
+	}
+	key := preparedKey{
+		compress:  m.send.doCompress,
+		level:     m.send.compressLevel,
+		chunkSize: con.config.ChunkSize,
+		assembled: !m.send.doMask && !m.send.streamlize,
+	}
+	f, e := pm.encode(key)
+	if e != nil {
+		return e
+	}
+
+	if key.assembled {
+		defer con.lockWrite(pm.Type)()
+		if e := con.writable(); e != nil {
+			return e
+		}
+		_, e := con.rawConnection.Write(f.raw)
+		return e
+	}
+	if !con.streamable {
+		// only lock when it's not streaming, or dead lock may occur
+		defer con.lockWrite(pm.Type)()
+	}
+	for i, chunk := range f.chunks {
+		frame := &Message{
+			send:       m.send,
+			config:     m.config,
+			isFirst:    i == 0,
+			isComplete: i == len(f.chunks)-1,
+			Type:       pm.Type,
+			payload:    chunk,
+		}
+		if e := con.writeSingleFrame(frame); e != nil {
+			return e
+		}
+	}
+	return nil
+}
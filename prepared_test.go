@@ -0,0 +1,134 @@
+package webson
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPreparedMessage(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		config Config
+		cached int // server writes assembled frames, client masks chunks, none for takeover
+	}{
+		{"plain", Config{}, 2},
+		{"no takeover", Config{EnableCompress: true, ServerNoContextTakeover: true, ClientNoContextTakeover: true}, 2},
+		{"takeover", Config{EnableCompress: true}, 0},
+		{"streams", Config{EnableStreams: true, EnableCompress: true}, 1},
+		{"private mask", Config{PrivateMask: []byte("webson!!")}, 2},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			prepared := NewPreparedMessage(TextMessage, bytes.Repeat([]byte("prepared "), 1000))
+			server := c.config
+			server.Synchronize = true
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, e := TakeOver(w, r, &server)
+				if e != nil {
+					return
+				}
+				ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+					msg, _ := m.Read()
+					// prepared msgs mixed with normal ones
+					if e := ws.DispatchPrepared(prepared); e != nil {
+						t.Error(e)
+					}
+					a.Dispatch(TextMessage, msg)
+				})
+				ws.Start()
+			}))
+			defer s.Close()
+
+			client := c.config
+			client.Synchronize = true
+			ws, e := Dial(s.URL, &DialConfig{Config: client})
+			if e != nil {
+				t.Fatal(e)
+			}
+			received := make(chan []byte, 10)
+			ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+				msg, e := m.Read()
+				if e != nil {
+					t.Error(e)
+				}
+				received <- msg
+			})
+			var expected [][]byte
+			ws.OnReady(func(a Adapter) {
+				for i := 0; i < 3; i++ {
+					ws.DispatchPrepared(prepared)
+					a.Dispatch(TextMessage, []byte("normal"))
+				}
+			})
+			for i := 0; i < 3; i++ {
+				expected = append(expected, prepared.payload, prepared.payload, prepared.payload, []byte("normal"))
+			}
+			go ws.Start()
+			defer ws.Close()
+			for _, msg := range expected {
+				select {
+				case r := <-received:
+					if !bytes.Equal(r, msg) {
+						t.Fatalf("unexpected msg %q", r[:10])
+					}
+				case <-time.After(time.Second):
+					t.Fatal("msg timeout")
+				}
+			}
+			prepared.lock.Lock()
+			defer prepared.lock.Unlock()
+			if len(prepared.frames) != c.cached {
+				t.Errorf("unexpected cached frames %d", len(prepared.frames))
+			}
+		})
+	}
+}
+
+func TestPreparedTakeover(t *testing.T) {
+	raw, peer := net.Pipe()
+	defer peer.Close()
+	c := &Config{PingInterval: -1, EnableCompress: true}
+	if e := c.setup(); e != nil {
+		t.Fatal(e)
+	}
+	con := &Connection{rawConnection: raw, config: c}
+	con.compressable, con.deflateTakeover, con.inflateTakeover = true, true, true
+	con.compressLevel = DEFAULT_COMPRESS_LEVEL
+	if e := con.prepare(); e != nil {
+		t.Fatal(e)
+	}
+	pool := NewPool(nil)
+	pool.Add(con, &NodeConfig{Name: "takeover"})
+	time.Sleep(10 * time.Millisecond)
+
+	payload := []byte(`{"name": "webson", "name": "webson"}`)
+	go func() {
+		for i := 0; i < 2; i++ {
+			pool.Dispatch(TextMessage, payload)
+		}
+	}()
+	// frames are compressed with the context of the connection
+	d := newDecompressor()
+	header := make([]byte, 2)
+	for i := 0; i < 2; i++ {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		if _, e := io.ReadFull(peer, header); e != nil {
+			t.Fatal(e)
+		}
+		if header[0]&0b0100_0000 == 0 {
+			t.Fatal("broadcast is not compressed")
+		}
+		frame := make([]byte, header[1])
+		if _, e := io.ReadFull(peer, frame); e != nil {
+			t.Fatal(e)
+		}
+		msg, e := d.decompress(frame)
+		if e != nil || !bytes.Equal(msg, payload) {
+			t.Fatalf("unexpected msg %q %v", msg, e)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package webson
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyFor decides which proxy to use for the target, nil for direct connect
+func (c *ClientConfig) proxyFor() (*url.URL, error) {
+	if c.Proxy != "" {
+		return url.Parse(c.Proxy)
+	}
+	if !c.ProxyFromEnv {
+		return nil, nil
+	}
+	// ws & wss follows the same proxy rules with http & https
+	proxy := getEnvAny("HTTP_PROXY", "http_proxy")
+	if c.UseTLS {
+		proxy = getEnvAny("HTTPS_PROXY", "https_proxy")
+	}
+	if proxy == "" || !useProxy(c.url.hostPort, getEnvAny("NO_PROXY", "no_proxy")) {
+		return nil, nil
+	}
+	u, e := url.Parse(proxy)
+	if e != nil || u.Host == "" {
+		// proxy without scheme, like 127.0.0.1:3128
+		if u, e := url.Parse("http://" + proxy); e == nil {
+			return u, nil
+		}
+	}
+	return u, e
+}
+
+// getEnvAny returns the first non-empty env, env is read every time so that changes take effect
+func getEnvAny(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// useProxy tells if hostPort should be proxied with the NO_PROXY rules, the same as net/http.
+// localhost & loopback addresses are never proxied.
+func useProxy(hostPort, noProxy string) bool {
+	host, port, e := net.SplitHostPort(hostPort)
+	if e != nil {
+		host = hostPort
+	}
+	host = strings.ToLower(host)
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return false
+	}
+	for _, p := range strings.Split(noProxy, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			return false
+		}
+		if _, cidr, e := net.ParseCIDR(p); e == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return false
+			}
+			continue
+		}
+		pHost, pPort, e := net.SplitHostPort(p)
+		if e != nil {
+			pHost, pPort = p, ""
+		}
+		if pPort != "" && pPort != port {
+			continue
+		}
+		if pIP := net.ParseIP(pHost); pIP != nil {
+			if ip != nil && pIP.Equal(ip) {
+				return false
+			}
+			continue
+		}
+		// .example.com matches sub domains only, example.com matches itself & sub domains
+		pHost = strings.TrimPrefix(pHost, "*")
+		if strings.HasPrefix(pHost, ".") {
+			if strings.HasSuffix(host, pHost) {
+				return false
+			}
+			continue
+		}
+		if host == pHost || strings.HasSuffix(host, "."+pHost) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialTCP get a tcp connection to the target, through proxy if necessary.
+// Proxy handshake is limited by handshakeTimeout & aborted once ctx is done.
+func (c *ClientConfig) dialTCP(ctx context.Context, handshakeTimeout time.Duration) (conn net.Conn, err error) {
+	proxy, e := c.proxyFor()
+	if e != nil {
+		return nil, e
+	}
+	var d net.Dialer
+	if proxy == nil {
+		return d.DialContext(ctx, "tcp", c.url.hostPort)
+	}
+
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		switch proxy.Scheme {
+		case "https":
+			proxyAddr += ":443"
+		case "socks5", "socks5h":
+			proxyAddr += ":1080"
+		default:
+			proxyAddr += ":80"
+		}
+	}
+	raw, e := d.DialContext(ctx, "tcp", proxyAddr)
+	if e != nil {
+		return nil, e
+	}
+	// proxy handshake should not block longer than ctx or handshakeTimeout
+	deadline, ok := ctx.Deadline()
+	if handshakeTimeout > 0 && (!ok || time.Until(deadline) > handshakeTimeout) {
+		deadline, ok = time.Now().Add(handshakeTimeout), true
+	}
+	if ok {
+		raw.SetDeadline(deadline)
+	}
+	stopWatch := watchContext(ctx, raw)
+	defer func() {
+		stopWatch()
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+	switch proxy.Scheme {
+	case "https":
+		tlsRaw := tls.Client(raw, &tls.Config{ServerName: proxy.Hostname()})
+		if e = tlsRaw.HandshakeContext(ctx); e == nil {
+			e = httpConnect(tlsRaw, proxy, c.url.hostPort)
+		}
+		raw = tlsRaw
+	case "http", "":
+		e = httpConnect(raw, proxy, c.url.hostPort)
+	case "socks5", "socks5h":
+		e = socks5Connect(raw, proxy, c.url.hostPort)
+	default:
+		e = fmt.Errorf("unsupported proxy scheme %s", proxy.Scheme)
+	}
+	if e != nil {
+		raw.Close()
+		return nil, e
+	}
+	raw.SetDeadline(time.Time{})
+	return raw, nil
+}
+
+// httpConnect creates a tunnel with http CONNECT method
+func httpConnect(raw net.Conn, proxy *url.URL, target string) error {
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		request += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n",
+			base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+password)))
+	}
+	if _, e := raw.Write([]byte(request + "\r\n")); e != nil {
+		return e
+	}
+	// proxy won't send anything more before tunnel is used, so nothing is lost in the buffer
+	resp, e := http.ReadResponse(bufio.NewReader(raw), &http.Request{Method: http.MethodConnect})
+	if e != nil {
+		return e
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy CONNECT failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// socks5Connect creates a tunnel with socks5 protocol, see RFC1928 & RFC1929
+func socks5Connect(raw net.Conn, proxy *url.URL, target string) error {
+	host, portStr, e := net.SplitHostPort(target)
+	if e != nil {
+		return e
+	}
+	port, e := strconv.Atoi(portStr)
+	if e != nil {
+		return e
+	}
+
+	methods := []byte{0x00} // no auth
+	if proxy.User != nil {
+		methods = append(methods, 0x02) // username & password
+	}
+	if _, e := raw.Write(append([]byte{0x05, byte(len(methods))}, methods...)); e != nil {
+		return e
+	}
+	vessel := make([]byte, 2)
+	if _, e := io.ReadFull(raw, vessel); e != nil {
+		return e
+	}
+	if vessel[0] != 0x05 {
+		return errors.New("socks5 version not match")
+	}
+	switch vessel[1] {
+	case 0x00:
+	case 0x02:
+		if proxy.User == nil {
+			return errors.New("socks5 auth required")
+		}
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("socks5 auth too long")
+		}
+		auth := []byte{0x01, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, e := raw.Write(auth); e != nil {
+			return e
+		}
+		if _, e := io.ReadFull(raw, vessel); e != nil {
+			return e
+		}
+		if vessel[1] != 0x00 {
+			return errors.New("socks5 auth failed")
+		}
+	default:
+		return errors.New("socks5 no acceptable auth method")
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(request, 0x01)
+			request = append(request, ip4...)
+		} else {
+			request = append(request, 0x04)
+			request = append(request, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("socks5 host too long")
+		}
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, e := raw.Write(request); e != nil {
+		return e
+	}
+
+	reply := make([]byte, 4)
+	if _, e := io.ReadFull(raw, reply); e != nil {
+		return e
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("socks5 connect failed with code %d", reply[1])
+	}
+	// skip bound address
+	skip := 0
+	switch reply[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		if _, e := io.ReadFull(raw, vessel[:1]); e != nil {
+			return e
+		}
+		skip = int(vessel[0])
+	default:
+		return errors.New("socks5 unknown address type")
+	}
+	_, e = io.ReadFull(raw, make([]byte, skip+2))
+	return e
+}
@@ -0,0 +1,176 @@
+package webson
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveProxy accepts connections & tunnels them to the target returned by handshake
+func serveProxy(t *testing.T, handshake func(net.Conn) string) string {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				target := handshake(c)
+				if target == "" {
+					return
+				}
+				remote, e := net.Dial("tcp", target)
+				if e != nil {
+					return
+				}
+				defer remote.Close()
+				go io.Copy(remote, c)
+				io.Copy(c, remote)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestHTTPConnectProxy(t *testing.T) {
+	s := newEchoServer(t, nil)
+	proxy := serveProxy(t, func(c net.Conn) string {
+		r, e := http.ReadRequest(bufio.NewReader(c))
+		if e != nil || r.Method != http.MethodConnect {
+			return ""
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")) {
+			c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return ""
+		}
+		c.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		return r.Host
+	})
+	echoOnce(t, s.URL, &DialConfig{
+		ClientConfig: ClientConfig{Proxy: "http://user:pass@" + proxy},
+	})
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	s := newEchoServer(t, nil)
+	proxy := serveProxy(t, func(c net.Conn) string {
+		vessel := make([]byte, 262)
+		if _, e := io.ReadFull(c, vessel[:2]); e != nil {
+			return ""
+		}
+		io.ReadFull(c, vessel[:vessel[1]])
+		c.Write([]byte{0x05, 0x00})
+		if _, e := io.ReadFull(c, vessel[:4]); e != nil || vessel[3] != 0x01 {
+			return ""
+		}
+		io.ReadFull(c, vessel[:6])
+		host := net.IP(vessel[:4]).String()
+		port := binary.BigEndian.Uint16(vessel[4:6])
+		c.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return net.JoinHostPort(host, strconv.Itoa(int(port)))
+	})
+	echoOnce(t, strings.Replace(s.URL, "http", "ws", 1), &DialConfig{
+		ClientConfig: ClientConfig{Proxy: "socks5://" + proxy},
+	})
+}
+
+func TestProxyDialCancel(t *testing.T) {
+	// proxy accepts but never answers the handshake
+	proxy := serveProxy(t, func(c net.Conn) string {
+		io.Copy(io.Discard, c)
+		return ""
+	})
+	for _, scheme := range []string{"http", "socks5"} {
+		t.Run(scheme, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			start := time.Now()
+			_, e := DialContext(ctx, "ws://127.0.0.1:1/", &DialConfig{
+				ClientConfig: ClientConfig{Proxy: scheme + "://" + proxy},
+			})
+			if time.Since(start) > 2*time.Second {
+				t.Error("proxy handshake is not aborted in time")
+			}
+			var de *DialError
+			if !errors.As(e, &de) || de.Phase != PhaseDial || !errors.Is(e, context.Canceled) {
+				t.Errorf("unexpected dial error %v", e)
+			}
+		})
+	}
+}
+
+func TestProxyFromEnv(t *testing.T) {
+	for _, name := range []string{"http_proxy", "https_proxy", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("HTTP_PROXY", "http://proxy:3128")
+	t.Setenv("HTTPS_PROXY", "socks5://secure:1080")
+	t.Setenv("NO_PROXY", "internal.com, .corp.com, 10.0.0.0/8, 192.168.1.1, api.com:8443")
+	for _, c := range []struct {
+		addr   string
+		expect string
+	}{
+		{"ws://example.com/", "http://proxy:3128"},
+		{"wss://example.com/", "socks5://secure:1080"},
+		{"ws://internal.com/", ""},
+		{"ws://a.internal.com/", ""},
+		{"ws://notinternal.com/", "http://proxy:3128"},
+		{"ws://a.corp.com/", ""},
+		{"ws://corp.com/", "http://proxy:3128"},
+		{"ws://10.1.2.3/", ""},
+		{"ws://192.168.1.1:8000/", ""},
+		{"ws://192.168.1.2/", "http://proxy:3128"},
+		{"wss://api.com:8443/", ""},
+		{"wss://api.com/", "socks5://secure:1080"},
+		{"ws://localhost:8000/", ""},
+		{"ws://127.0.0.1:8000/", ""},
+	} {
+		u := parseUrl(c.addr)
+		config := &ClientConfig{ProxyFromEnv: true, UseTLS: u.useTLS, url: u}
+		proxy, e := config.proxyFor()
+		if e != nil {
+			t.Fatal(e)
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != c.expect {
+			t.Errorf("proxy for %s is %q, expect %q", c.addr, got, c.expect)
+		}
+	}
+
+	t.Setenv("NO_PROXY", "*")
+	c := &ClientConfig{ProxyFromEnv: true, url: parseUrl("ws://example.com/")}
+	if proxy, _ := c.proxyFor(); proxy != nil {
+		t.Error("* should bypass all", proxy)
+	}
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("HTTP_PROXY", "proxy:3128")
+	if proxy, _ := c.proxyFor(); proxy == nil || proxy.String() != "http://proxy:3128" {
+		t.Error("proxy without scheme", proxy)
+	}
+	c.ProxyFromEnv = false
+	if proxy, _ := c.proxyFor(); proxy != nil {
+		t.Error("env is used without ProxyFromEnv", proxy)
+	}
+	c.Proxy = "http://explicit:80"
+	if proxy, _ := c.proxyFor(); proxy == nil || proxy.Host != "explicit:80" {
+		t.Error("explicit proxy is not used", proxy)
+	}
+}
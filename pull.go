@@ -0,0 +1,130 @@
+package webson
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ReadMessage pulls the next data msg in order, the read loop is started in background if it's not running.
+//
+// Once pulling is enabled, text & binary msgs without OnMessage callback of their type are queued for ReadMessage.
+// Up to Config.PullBuffer msgs are buffered while the read loop goes on, so control msgs (ping/pong/close) are still
+// handled underneath. When the buffer is full, the read loop waits until a msg is pulled or the peer is gone,
+// pings are not answered and close is not acked meanwhile, so keep pulling.
+// Callbacks take precedence, msgs with a callback are never queued. Applied EventHandlers see all msgs as usual,
+// other types like RPC are left to their handlers.
+// Msgs buffered before the connection is closed can still be pulled, io.EOF or the reading error is returned after them.
+func (con *Connection) ReadMessage(ctx context.Context) (*Message, error) {
+	select {
+	case m, ok := <-con.Messages():
+		if !ok {
+			return nil, con.pullErr()
+		}
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Messages is the channel form of ReadMessage, it's closed after the connection is closed
+func (con *Connection) Messages() <-chan *Message {
+	con.statusLock.Lock()
+	defer con.statusLock.Unlock()
+	if con.pulled != nil {
+		return con.pulled
+	}
+	if con.status == StatusClosed && !con.started {
+		if con.unpulled != nil {
+			return con.unpulled
+		}
+		closed := make(chan *Message)
+		close(closed)
+		return closed
+	}
+	con.unpulled = nil
+	size := con.config.PullBuffer
+	if size < 0 {
+		size = 0
+	}
+	con.pulled = make(chan *Message, size)
+	if !con.started {
+		con.started = true
+		go con.run()
+	}
+	return con.pulled
+}
+
+func (con *Connection) pullErr() error {
+	con.statusLock.Lock()
+	defer con.statusLock.Unlock()
+	if con.readErr != nil {
+		return con.readErr
+	}
+	return io.EOF
+}
+
+// pull queues the msg if pulling is enabled. If the buffer is full, it waits until the msg is pulled,
+// this side starts to close or the peer is gone
+func (con *Connection) pull(m *Message) {
+	con.statusLock.Lock()
+	pulled, closing := con.pulled, con.closing
+	con.statusLock.Unlock()
+	if pulled == nil {
+		return
+	}
+	m.receive.pulled = true
+	select {
+	case pulled <- m:
+		return
+	case <-closing:
+		return
+	default:
+	}
+
+	// the buffer is full & the read loop is blocked, watch the connection meanwhile
+	gone := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		if con.peerGone() {
+			close(gone)
+		}
+	}()
+	select {
+	case pulled <- m:
+	case <-closing:
+	case <-gone:
+	}
+	// interrupt the watching before reading again
+	con.rawConnection.SetReadDeadline(time.Now())
+	<-watched
+	con.rawConnection.SetReadDeadline(time.Time{})
+}
+
+// peerGone peeks the connection until it fails, so that frames received meanwhile are kept for the read loop.
+// It returns false if it's interrupted by read deadline or the buffer is full.
+func (con *Connection) peerGone() bool {
+	r := con.frames.reader
+	for n := r.Buffered() + 1; n <= r.Size(); n = r.Buffered() + 1 {
+		if _, e := r.Peek(n); e != nil {
+			var ne net.Error
+			return !errors.As(e, &ne) || !ne.Timeout()
+		}
+	}
+	return false
+}
+
+// stopPulling closes the queue after the read loop stops, msgs left are kept for pulling
+func (con *Connection) stopPulling(e error) {
+	con.statusLock.Lock()
+	defer con.statusLock.Unlock()
+	con.started = false
+	con.readErr = e
+	if con.pulled != nil {
+		close(con.pulled)
+		con.unpulled, con.pulled = con.pulled, nil
+	}
+}
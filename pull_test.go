@@ -0,0 +1,179 @@
+package webson
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadMessage(t *testing.T) {
+	s := newEchoServer(t, &Config{Synchronize: true})
+	ws, e := Dial(s.URL, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	ready := make(chan struct{})
+	ws.OnReady(func(a Adapter) {
+		close(ready)
+	})
+	callback := make(chan string, 1)
+	ws.OnMessage(PongMessage, func(m *Message, a Adapter) {
+		callback <- "pong"
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	// read loop is started by pulling
+	if _, e := ws.ReadMessage(ctx); e != context.DeadlineExceeded {
+		t.Fatalf("unexpected result %v", e)
+	}
+	<-ready
+	if ws.Start() == nil {
+		t.Error("start twice")
+	}
+
+	for _, msg := range []string{"1", "2", "3"} {
+		ws.Dispatch(TextMessage, []byte(msg))
+	}
+	ws.Ping()
+	for _, expect := range []string{"1", "2", "3"} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		m, e := ws.ReadMessage(ctx)
+		cancel()
+		if e != nil {
+			t.Fatal(e)
+		}
+		if msg, _ := m.Read(); string(msg) != expect {
+			t.Errorf("unexpected msg %s, expect %s", msg, expect)
+		}
+	}
+	select {
+	case <-callback:
+	case <-time.After(time.Second):
+		t.Error("control msg is not handled")
+	}
+
+	ws.Close()
+	if _, e := ws.ReadMessage(context.Background()); e != io.EOF {
+		t.Errorf("unexpected result after close %v", e)
+	}
+	if _, ok := <-ws.Messages(); ok {
+		t.Error("messages are not closed")
+	}
+}
+
+func TestPullPeerGone(t *testing.T) {
+	// without buffer, the read loop waits for pulling & watches the peer meanwhile
+	for _, buffer := range []int{-1, 0} {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, e := TakeOver(w, r, nil)
+			if e != nil {
+				return
+			}
+			ws.OnReady(func(a Adapter) {
+				// private types are left to their handlers
+				a.Dispatch(MessageType(5), []byte("cluster"))
+				a.Dispatch(TextMessage, []byte("1"))
+				a.Dispatch(TextMessage, []byte("2"))
+				time.Sleep(50 * time.Millisecond)
+				// gone without close frame
+				ws.rawConnection.Close()
+			})
+			ws.Start()
+		}))
+
+		ws, e := Dial(s.URL, &DialConfig{Config: Config{PullBuffer: buffer}})
+		if e != nil {
+			t.Fatal(e)
+		}
+		closed := make(chan struct{})
+		ws.OnStatus(StatusClosed, func(s Status, a Adapter) {
+			close(closed)
+		})
+		m, e := ws.ReadMessage(context.Background())
+		if e != nil {
+			t.Fatal(e)
+		}
+		if msg, _ := m.Read(); m.Type != TextMessage || string(msg) != "1" {
+			t.Errorf("unexpected msg %d %s", m.Type, msg)
+		}
+		// the read loop stops without pulling
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("read loop is blocked after the peer is gone")
+		}
+		if buffer >= 0 {
+			// buffered msgs are kept
+			m, e := ws.ReadMessage(context.Background())
+			if e != nil {
+				t.Fatal(e)
+			}
+			if msg, _ := m.Read(); string(msg) != "2" {
+				t.Errorf("unexpected msg %s", msg)
+			}
+		}
+		if _, e := ws.ReadMessage(context.Background()); e == nil {
+			t.Error("pull after the peer is gone")
+		}
+		s.Close()
+	}
+}
+
+func TestPullControlFrames(t *testing.T) {
+	ponged := make(chan struct{}, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, nil)
+		if e != nil {
+			return
+		}
+		// pings from KeepPing are answered too
+		ws.OnMessage(PongMessage, func(m *Message, a Adapter) {
+			select {
+			case ponged <- struct{}{}:
+				a.Close()
+			default:
+			}
+		})
+		ws.OnReady(func(a Adapter) {
+			a.Dispatch(TextMessage, []byte("1"))
+			a.Dispatch(PingMessage, []byte("parked"))
+		})
+		ws.Start()
+	}))
+	defer s.Close()
+
+	ws, e := Dial(s.URL, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	closed := make(chan struct{})
+	ws.OnStatus(StatusClosed, func(s Status, a Adapter) {
+		close(closed)
+	})
+	// pulling is enabled, but nothing is pulled
+	ws.Messages()
+	select {
+	case <-ponged:
+	case <-time.After(time.Second):
+		t.Fatal("ping is not answered while msgs are not pulled")
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close is not handled while msgs are not pulled")
+	}
+	m, e := ws.ReadMessage(context.Background())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if msg, _ := m.Read(); string(msg) != "1" {
+		t.Errorf("unexpected msg %s", msg)
+	}
+	if _, e := ws.ReadMessage(context.Background()); e != io.EOF {
+		t.Errorf("unexpected result after close %v", e)
+	}
+}
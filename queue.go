@@ -0,0 +1,151 @@
+package webson
+
+import (
+	"sync"
+	"time"
+)
+
+// QueuePolicy decides what to do when the send queue is full
+type QueuePolicy int
+
+const (
+	QueueError      = QueuePolicy(0) // refuse the new msg with QueueFull
+	QueueDropOldest = QueuePolicy(1) // drop the oldest msg in queue for the new one
+	QueueDropNewest = QueuePolicy(2) // drop the new msg silently
+	QueueBlock      = QueuePolicy(3) // block until there's room or the connection is closed
+)
+
+type queuedMsg struct {
+	t        MessageType
+	payload  []byte
+	expireAt time.Time
+}
+
+func (m *queuedMsg) expired(now time.Time) bool {
+	return !m.expireAt.IsZero() && now.After(m.expireAt)
+}
+
+// sendQueue buffers data messages when connection is not ready, flush them in order once it's ready again
+type sendQueue struct {
+	config *SendQueue
+
+	lock     sync.Mutex
+	room     *sync.Cond
+	msgs     []*queuedMsg
+	flushing bool
+}
+
+func newSendQueue(c *SendQueue) *sendQueue {
+	q := &sendQueue{config: c}
+	q.room = sync.NewCond(&q.lock)
+	return q
+}
+
+// queueable status are transient, msgs can be sent after that
+func queueable(s Status) bool {
+	return s == StatusYetReady || s == StatusTimeout || s == StatusReconnecting
+}
+
+// offer tries to queue the msg, returns false if msg should be sent directly
+func (q *sendQueue) offer(con *Connection, t MessageType, p []byte) (bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		status := con.currentStatus()
+		if !queueable(status) {
+			// keep the order if it's still flushing
+			if status != StatusReady || len(q.msgs) == 0 && !q.flushing {
+				return false, nil
+			}
+		}
+		if len(q.msgs) >= q.config.Size {
+			q.purge()
+		}
+		if len(q.msgs) < q.config.Size {
+			break
+		}
+		switch q.config.Policy {
+		case QueueDropOldest:
+			q.msgs = q.msgs[1:]
+		case QueueDropNewest:
+			return true, nil
+		case QueueBlock:
+			q.room.Wait()
+			continue
+		default:
+			return true, QueueFull{}
+		}
+		break
+	}
+
+	m := &queuedMsg{t: t, payload: append([]byte(nil), p...)} // payload may be reused by the caller
+	if q.config.Expire > 0 {
+		m.expireAt = time.Now().Add(q.config.Expire)
+	}
+	q.msgs = append(q.msgs, m)
+	return true, nil
+}
+
+// purge removes expired msgs
+func (q *sendQueue) purge() {
+	now := time.Now()
+	left := q.msgs[:0]
+	for _, m := range q.msgs {
+		if !m.expired(now) {
+			left = append(left, m)
+		}
+	}
+	q.msgs = left
+}
+
+// wake up blocked offers, they will decide to queue or not by the status
+func (q *sendQueue) wake() {
+	q.lock.Lock()
+	q.room.Broadcast()
+	q.lock.Unlock()
+}
+
+// flush sends queued msgs in order, stop at the first failure
+func (q *sendQueue) flush(con *Connection) {
+	q.lock.Lock()
+	if q.flushing {
+		q.lock.Unlock()
+		return
+	}
+	q.flushing = true
+	q.lock.Unlock()
+
+	for {
+		q.lock.Lock()
+		if len(q.msgs) == 0 {
+			q.flushing = false
+			q.lock.Unlock()
+			return
+		}
+		m := q.msgs[0]
+		q.msgs = q.msgs[1:]
+		q.room.Broadcast()
+		q.lock.Unlock()
+
+		if m.expired(time.Now()) {
+			continue
+		}
+		if e := con.dispatch(m.t, m.payload); e != nil {
+			q.lock.Lock()
+			q.msgs = append([]*queuedMsg{m}, q.msgs...)
+			q.flushing = false
+			q.lock.Unlock()
+			// flushed again when it's ready again, retry later if it's still ready,
+			// or new msgs will keep queueing behind
+			if con.currentStatus() == StatusReady {
+				time.AfterFunc(queue_retry_interval, func() {
+					if con.currentStatus() == StatusReady {
+						q.flush(con)
+					}
+				})
+			}
+			return
+		}
+	}
+}
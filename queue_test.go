@@ -0,0 +1,159 @@
+package webson
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendQueuePolicy(t *testing.T) {
+	for _, c := range []struct {
+		policy QueuePolicy
+		err    error
+		expect string
+	}{
+		{QueueError, QueueFull{}, "ab"},
+		{QueueDropOldest, nil, "bc"},
+		{QueueDropNewest, nil, "ab"},
+	} {
+		con := &Connection{status: StatusYetReady}
+		q := newSendQueue(&SendQueue{Size: 2, Policy: c.policy})
+		for _, p := range []string{"a", "b"} {
+			if queued, e := q.offer(con, TextMessage, []byte(p)); !queued || e != nil {
+				t.Fatalf("msg not queued %v", e)
+			}
+		}
+		if _, e := q.offer(con, TextMessage, []byte("c")); e != c.err {
+			t.Errorf("policy %d: unexpected error %v", c.policy, e)
+		}
+		left := ""
+		for _, m := range q.msgs {
+			left += string(m.payload)
+		}
+		if left != c.expect {
+			t.Errorf("policy %d: unexpected queue %s", c.policy, left)
+		}
+	}
+}
+
+func TestSendQueueExpire(t *testing.T) {
+	con := &Connection{status: StatusTimeout}
+	q := newSendQueue(&SendQueue{Size: 1, Policy: QueueBlock, Expire: 10 * time.Millisecond})
+	q.offer(con, TextMessage, []byte("a"))
+	done := make(chan bool)
+	go func() {
+		// room is made by purging expired msg
+		time.Sleep(20 * time.Millisecond)
+		q.offer(con, TextMessage, []byte("b"))
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expired msg is not purged")
+	}
+	if len(q.msgs) != 1 || string(q.msgs[0].payload) != "b" {
+		t.Error("unexpected queue")
+	}
+
+	con.status = StatusReady
+	blocked := make(chan bool)
+	go func() {
+		// queue is full & waiting for flush
+		q.offer(con, TextMessage, []byte("c"))
+		blocked <- false
+	}()
+	time.Sleep(10 * time.Millisecond)
+	con.statusLock.Lock()
+	con.status = StatusClosed
+	con.statusLock.Unlock()
+	q.wake()
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("blocked offer not waken")
+	}
+}
+
+func TestDispatchBeforeStart(t *testing.T) {
+	s := newEchoServer(t, &Config{Synchronize: true})
+	ws, e := Dial(s.URL, &DialConfig{Config: Config{Synchronize: true, SendQueue: &SendQueue{Size: 10}}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, p := range []string{"a", "b", "c"} {
+		if e := ws.Dispatch(TextMessage, []byte(p)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	received := make(chan string, 3)
+	ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+		msg, _ := m.Read()
+		received <- string(msg)
+	})
+	go ws.Start()
+	defer ws.Close()
+	for _, expect := range []string{"a", "b", "c"} {
+		select {
+		case msg := <-received:
+			if msg != expect {
+				t.Errorf("unexpected msg %s", msg)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("queued msg not flushed")
+		}
+	}
+}
+
+// flakyConn fails the first writes
+type flakyConn struct {
+	net.Conn
+	lock  sync.Mutex
+	fails int
+}
+
+func (c *flakyConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	if c.fails > 0 {
+		c.fails -= 1
+		c.lock.Unlock()
+		return 0, errors.New("write failed")
+	}
+	c.lock.Unlock()
+	return c.Conn.Write(p)
+}
+
+func TestSendQueueFlushRetry(t *testing.T) {
+	s := newEchoServer(t, &Config{Synchronize: true})
+	ws, e := Dial(s.URL, &DialConfig{Config: Config{Synchronize: true, SendQueue: &SendQueue{Size: 10}}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, p := range []string{"a", "b"} {
+		ws.Dispatch(TextMessage, []byte(p))
+	}
+	ws.rawConnection = &flakyConn{Conn: ws.rawConnection, fails: 1}
+	received := make(chan string, 3)
+	ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+		msg, _ := m.Read()
+		received <- string(msg)
+	})
+	ws.OnReady(func(a Adapter) {
+		// queued behind the failed flush
+		a.Dispatch(TextMessage, []byte("c"))
+	})
+	go ws.Start()
+	defer ws.Close()
+	for _, expect := range []string{"a", "b", "c"} {
+		select {
+		case msg := <-received:
+			if msg != expect {
+				t.Errorf("unexpected msg %s", msg)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("queue is not flushed after failure")
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package webson
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+// frameReader is the frame reading state of a serving connection,
+// shared by the serve loop & msg readers in synchronized handlers
+type frameReader struct {
+	reader  *bufio.Reader
+	vessel2 []byte
+	vessel4 []byte
+	vessel8 []byte
+
+	stopped bool
+	err     error
+}
+
+// frameChunks passes payload of an incomplete msg to its reader frame by frame.
+// Frames are pushed by the serve loop which waits for the reader to catch up,
+// or pulled by the reader itself in synchronized handler.
+// With stream flow control, the serve loop never waits, the other side waits for consumed bytes granted instead.
+type frameChunks struct {
+	pull     func() error // nil if frames are pushed
+	flow     *streamFlow
+	streamId int
+	credit   int
+	granted  int // bytes granted already when they are received
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte
+	eof    bool  // all frames are received
+	err    error // canceled or connection lost
+	closed bool  // closed by the reader, frames left are dropped
+}
+
+func newFrameChunks(first []byte, pull func() error) *frameChunks {
+	c := &frameChunks{pull: pull}
+	c.cond = sync.NewCond(&c.lock)
+	if len(first) > 0 {
+		c.chunks = append(c.chunks, first)
+	}
+	return c
+}
+
+// push a frame, it blocks until the reader takes the former one
+func (c *frameChunks) push(chunk []byte, last bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.pull == nil && c.flow == nil && len(c.chunks) > 0 && !c.closed && c.err == nil {
+		c.cond.Wait()
+	}
+	if c.closed || c.err != nil {
+		return
+	}
+	if len(chunk) > 0 {
+		c.chunks = append(c.chunks, chunk)
+	}
+	c.eof = last
+	c.cond.Broadcast()
+}
+
+func (c *frameChunks) fail(e error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.eof && c.err == nil {
+		c.err = e
+	}
+	c.cond.Broadcast()
+}
+
+func (c *frameChunks) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	c.chunks = nil
+	c.cond.Broadcast()
+}
+
+// withFlow grants consumed bytes of the stream, the first chunk is granted already
+func (c *frameChunks) withFlow(f *streamFlow, streamId int) *frameChunks {
+	c.flow, c.streamId = f, streamId
+	for _, chunk := range c.chunks {
+		c.granted += len(chunk)
+	}
+	return c
+}
+
+// consume grants bytes taken by the reader, called without lock
+func (c *frameChunks) consume(n int) {
+	if c.flow == nil {
+		return
+	}
+	if c.granted >= n {
+		c.granted -= n
+		return
+	}
+	n, c.granted = n-c.granted, 0
+	c.flow.grant(c.streamId, &c.credit, n)
+}
+
+func (c *frameChunks) Read(p []byte) (int, error) {
+	n, e := c.read(p)
+	c.consume(n)
+	return n, e
+}
+
+// next takes the next chunk as a whole
+func (c *frameChunks) next() ([]byte, error) {
+	c.lock.Lock()
+	if e := c.wait(); e != nil {
+		c.lock.Unlock()
+		return nil, e
+	}
+	chunk := c.chunks[0]
+	c.chunks = c.chunks[1:]
+	c.cond.Broadcast()
+	c.lock.Unlock()
+	c.consume(len(chunk))
+	return chunk, nil
+}
+
+func (c *frameChunks) read(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e := c.wait(); e != nil {
+		return 0, e
+	}
+	n := copy(p, c.chunks[0])
+	if c.chunks[0] = c.chunks[0][n:]; len(c.chunks[0]) == 0 {
+		c.chunks = c.chunks[1:]
+		c.cond.Broadcast()
+	}
+	return n, nil
+}
+
+// wait for chunks with lock held
+func (c *frameChunks) wait() error {
+	for len(c.chunks) == 0 {
+		switch {
+		case c.closed:
+			return errors.New("read after close")
+		case c.err != nil:
+			return c.err
+		case c.eof:
+			return io.EOF
+		case c.pull != nil:
+			c.lock.Unlock()
+			e := c.pull()
+			c.lock.Lock()
+			if e != nil && c.err == nil && !c.eof {
+				c.err = e
+			}
+		default:
+			c.cond.Wait()
+		}
+	}
+	return nil
+}
+
+// msgReader streams payload of the msg, decompressed on the fly
+type msgReader struct {
+	chunks   *frameChunks
+	src      io.Reader
+	inflater *decompressor // locked until the msg is read to the end if other side keeps compress context
+}
+
+func (r *msgReader) Read(p []byte) (int, error) {
+	n, e := r.src.Read(p)
+	if r.inflater != nil {
+		r.inflater.remember(p[:n])
+		if e != nil {
+			r.inflater.release()
+			r.inflater = nil
+		}
+	}
+	return n, e
+}
+
+// Close the reader, frames left are dropped.
+// The msg will be read to the end if other side keeps compress context, or msgs after it can't be decompressed.
+func (r *msgReader) Close() error {
+	if r.inflater != nil {
+		io.Copy(io.Discard, r)
+	}
+	r.chunks.close()
+	return nil
+}
+
+// chunks for streaming the incomplete msg, with flow control if it's a stream
+func (m *Message) chunks(first []byte, pull func() error) *frameChunks {
+	c := newFrameChunks(first, pull)
+	if m.config.flow != nil && m.receive.isStream {
+		c.withFlow(m.config.flow, m.receive.streamId)
+	}
+	return c
+}
+
+func failedReader(e error) *msgReader {
+	return &msgReader{chunks: newFrameChunks(nil, nil), src: &frameChunks{err: e}}
+}
+
+// Reader streams the payload, decompressed on the fly.
+//
+// Handlers are triggered with the complete msg without Config.TriggerOnStart, so the whole payload is buffered
+// before Reader is called, use Connection.OnReader to stream msgs of a type without TriggerOnStart.
+// With TriggerOnStart or OnReader, payload of the incomplete msg is read frame by frame as they arrive,
+// and the connection stops reading until the reader takes the former frame.
+// With Config.Synchronize, the reader reads frames from connection by itself, so read it before the handler returns.
+// Only one reader can stream the incomplete msg, Read can't be used after that. Close the reader when it's done.
+func (m *Message) Reader() io.ReadCloser {
+	m.receive.updateLock.Lock()
+	defer m.receive.updateLock.Unlock()
+
+	switch {
+	case m.receive.reader != nil || m.receive.poolReading:
+		return failedReader(errors.New("msg is being read by another reader"))
+	case m.receive.streamCancel:
+		return failedReader(errors.New("stream canceled"))
+	case m.receive.lost:
+		return failedReader(io.ErrUnexpectedEOF)
+	}
+	if m.isComplete || !m.config.triggerOnStart {
+		// msg can be read by multiple handlers, keep the entity intact
+		src := io.Reader(bytes.NewReader(m.entity.Bytes()))
+		if m.receive.compressed {
+			src = flate.NewReader(io.MultiReader(src, bytes.NewReader(deflateTail)))
+		}
+		return &msgReader{chunks: newFrameChunks(nil, nil), src: src}
+	}
+
+	var pull func() error
+	if m.config.synchronized && !m.receive.pulled {
+		pull = m.config.pullFrame
+	}
+	r := &msgReader{chunks: m.chunks(m.entity.Bytes(), pull)}
+	r.src = r.chunks
+	if m.receive.compressed {
+		if m.config.inflater != nil {
+			src, e := m.config.inflater.stream(r.chunks)
+			if e != nil {
+				return failedReader(e)
+			}
+			r.src, r.inflater = src, m.config.inflater
+		} else {
+			r.src = flate.NewReader(io.MultiReader(r.chunks, bytes.NewReader(deflateTail)))
+		}
+	}
+	m.receive.reader = r.chunks
+	return r
+}
@@ -0,0 +1,166 @@
+package webson
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMessageReader(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		config Config
+	}{
+		{"async", Config{TriggerOnStart: true}},
+		{"synchronized", Config{TriggerOnStart: true, Synchronize: true}},
+		{"complete", Config{}},
+		{"compress", Config{TriggerOnStart: true, EnableCompress: true, ClientNoContextTakeover: true}},
+		{"compress takeover", Config{TriggerOnStart: true, EnableCompress: true}},
+		{"synchronized takeover", Config{TriggerOnStart: true, Synchronize: true, EnableCompress: true}},
+		{"streams", Config{TriggerOnStart: true, EnableStreams: true, EnableCompress: true}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server := c.config
+			received := make(chan []byte, 3)
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, e := TakeOver(w, r, &server)
+				if e != nil {
+					return
+				}
+				ws.OnMessage(BinaryMessage, func(m *Message, a Adapter) {
+					r := m.Reader()
+					defer r.Close()
+					payload, e := io.ReadAll(r)
+					if e != nil {
+						t.Error(e)
+					}
+					received <- payload
+				})
+				ws.Start()
+			}))
+			defer s.Close()
+
+			ws, e := Dial(s.URL, &DialConfig{Config: Config{
+				EnableCompress: c.config.EnableCompress,
+				EnableStreams:  c.config.EnableStreams,
+			}})
+			if e != nil {
+				t.Fatal(e)
+			}
+			var sent [][]byte
+			for _, size := range []int{100 * 1024, 10, 300 * 1024} {
+				payload := make([]byte, size)
+				rand.Read(payload[:size/2])
+				sent = append(sent, payload)
+			}
+			ws.OnReady(func(a Adapter) {
+				for _, payload := range sent {
+					if e := a.DispatchReader(BinaryMessage, bytes.NewReader(payload)); e != nil {
+						t.Error(e)
+					}
+				}
+			})
+			go ws.Start()
+			defer ws.Close()
+			// async handlers may finish in any order, sizes are different
+			for range sent {
+				select {
+				case r := <-received:
+					matched := false
+					for _, payload := range sent {
+						matched = matched || bytes.Equal(r, payload)
+					}
+					if !matched {
+						t.Fatalf("unexpected payload %d", len(r))
+					}
+				case <-time.After(3 * time.Second):
+					t.Fatal("msg not received")
+				}
+			}
+		})
+	}
+}
+
+func TestOnReader(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		config Config
+	}{
+		{"async", Config{}},
+		{"synchronized", Config{Synchronize: true}},
+		{"compress takeover", Config{EnableCompress: true}},
+		{"streams", Config{EnableStreams: true}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			started := make(chan []byte, 1)
+			received := make(chan []byte, 1)
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// triggered on first fragment without TriggerOnStart
+				config := c.config
+				ws, e := TakeOver(w, r, &config)
+				if e != nil {
+					return
+				}
+				ws.OnReader(BinaryMessage, func(r io.Reader, a Adapter) {
+					head := make([]byte, 6)
+					if _, e := io.ReadFull(r, head); e != nil {
+						t.Error(e)
+					}
+					started <- head
+					rest, e := io.ReadAll(r)
+					if e != nil {
+						t.Error(e)
+					}
+					received <- rest
+				})
+				ws.Start()
+			}))
+			defer s.Close()
+
+			ws, e := Dial(s.URL, &DialConfig{Config: Config{
+				EnableCompress: c.config.EnableCompress,
+				EnableStreams:  c.config.EnableStreams,
+			}})
+			if e != nil {
+				t.Fatal(e)
+			}
+			go ws.Start()
+			defer ws.Close()
+			time.Sleep(10 * time.Millisecond)
+
+			w, e := ws.NextWriter(BinaryMessage)
+			if e != nil {
+				t.Fatal(e)
+			}
+			w.Write([]byte("webson"))
+			if e := w.Flush(); e != nil {
+				t.Fatal(e)
+			}
+			select {
+			case head := <-started:
+				if string(head) != "webson" {
+					t.Errorf("unexpected head %q", head)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("not triggered on first fragment")
+			}
+			rest := bytes.Repeat([]byte("reader"), 2000)
+			w.Write(rest)
+			if e := w.Close(); e != nil {
+				t.Fatal(e)
+			}
+			select {
+			case r := <-received:
+				if !bytes.Equal(r, rest) {
+					t.Errorf("unexpected rest %d", len(r))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("msg not received")
+			}
+		})
+	}
+}
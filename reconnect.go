@@ -0,0 +1,89 @@
+package webson
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// OnReconnect binds handler before every reconnect attempt, attempt starts from 1
+func (con *Connection) OnReconnect(action func(attempt int, a Adapter)) {
+	con.reconnectHandler = action
+}
+
+// willReconnect tells whether lost connection should be recovered
+func (con *Connection) willReconnect() bool {
+	con.statusLock.Lock()
+	defer con.statusLock.Unlock()
+	return con.client != nil && con.client.Reconnect != nil && !con.startClose
+}
+
+// renegotiate creates a new underlying connection with the same dialer & reset states
+func (con *Connection) renegotiate(reconnecting bool) error {
+	raw, nego, e := negotiate(context.Background(), con.client, con.config)
+	if e != nil {
+		return e
+	}
+	raw.SetDeadline(time.Time{})
+
+	con.statusLock.Lock()
+	defer con.statusLock.Unlock()
+	if reconnecting && con.startClose {
+		// closed by this side while reconnecting
+		raw.Close()
+		return WriteAfterClose{}
+	}
+	con.rawConnection = raw
+	con.negoSet = *nego
+	if e := con.setupCompress(); e != nil {
+		raw.Close()
+		return e
+	}
+	con.setupFlow()
+	con.setupSessions()
+	con.pendingStreams = make(map[int]*Message)
+	con.inUseStreams = make(map[int]struct{})
+	if con.startClose {
+		con.closing = make(chan struct{})
+	}
+	con.startClose = false
+	con.closed = false
+	return nil
+}
+
+// reconnect tries with exponential backoff until succeeded or attempts are used up
+func (con *Connection) reconnect() error {
+	policy := con.client.Reconnect
+	delay := policy.MinDelay
+	var lastErr error
+	for attempt := 1; policy.MaxAttempts <= 0 || attempt <= policy.MaxAttempts; attempt++ {
+		wait := delay
+		if policy.Jitter > 0 {
+			wait += time.Duration((rand.Float64()*2 - 1) * policy.Jitter * float64(delay))
+		}
+		select {
+		case <-time.After(wait):
+		case <-con.closing:
+			return errors.New("closed while reconnecting")
+		}
+
+		if con.reconnectHandler != nil {
+			con.reconnectHandler(attempt, con)
+		}
+		if lastErr = con.renegotiate(true); lastErr == nil {
+			return nil
+		}
+		if _, closed := lastErr.(WriteAfterClose); closed {
+			return errors.New("closed while reconnecting")
+		}
+
+		delay = time.Duration(float64(delay) * policy.Factor)
+		if delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+	con.updateStatus(StatusClosed)
+	return fmt.Errorf("reconnect failed after %d attempts: %w", policy.MaxAttempts, lastErr)
+}
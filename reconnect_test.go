@@ -0,0 +1,114 @@
+package webson
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReconnect(t *testing.T) {
+	var lock sync.Mutex
+	var servers []*Connection
+	tokens := make(chan string, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens <- r.Header.Get("Token")
+		ws, e := TakeOver(w, r, &Config{Synchronize: true})
+		if e != nil {
+			return
+		}
+		lock.Lock()
+		servers = append(servers, ws)
+		lock.Unlock()
+		ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+			msg, _ := m.Read()
+			a.Dispatch(TextMessage, msg)
+		})
+		ws.Start()
+	}))
+	defer s.Close()
+
+	refreshed := 0
+	ws, e := Dial(s.URL, &DialConfig{Config: Config{Synchronize: true, SendQueue: &SendQueue{Size: 10}}, ClientConfig: ClientConfig{
+		HeaderRefresh: func() map[string]string {
+			refreshed += 1
+			return map[string]string{"Token": string(rune('0' + refreshed))}
+		},
+		Reconnect: &Reconnect{MinDelay: 10 * time.Millisecond, MaxAttempts: 3},
+	}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	attempts := make(chan int, 10)
+	ws.OnReconnect(func(attempt int, a Adapter) {
+		attempts <- attempt
+	})
+	received := make(chan string, 10)
+	ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+		msg, _ := m.Read()
+		received <- string(msg)
+	})
+	reconnecting := make(chan bool, 1)
+	ws.OnStatus(StatusReconnecting, func(s Status, a Adapter) {
+		// buffered until reconnected
+		for _, msg := range []string{"a", "b", "c"} {
+			if e := a.Dispatch(TextMessage, []byte(msg)); e != nil {
+				t.Error(e)
+			}
+		}
+		reconnecting <- true
+	})
+	done := make(chan error)
+	go func() {
+		done <- ws.Start()
+	}()
+
+	if token := <-tokens; token != "1" {
+		t.Errorf("unexpected token %s", token)
+	}
+	time.Sleep(10 * time.Millisecond)
+	lock.Lock()
+	// server side lost the connection
+	servers[0].rawConnection.Close()
+	lock.Unlock()
+
+	if token := <-tokens; token != "2" {
+		t.Errorf("token is not refreshed %s", token)
+	}
+	<-reconnecting
+	if attempt := <-attempts; attempt != 1 {
+		t.Errorf("unexpected attempt %d", attempt)
+	}
+	for _, expect := range []string{"a", "b", "c"} {
+		select {
+		case msg := <-received:
+			if msg != expect {
+				t.Errorf("unexpected msg %s", msg)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("buffered msg not flushed")
+		}
+	}
+
+	ws.Close()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Error("Start not returned after Close")
+	}
+}
+
+func TestReconnectBufferSize(t *testing.T) {
+	s := newEchoServer(t, nil)
+	ws, e := Dial(s.URL, &DialConfig{ClientConfig: ClientConfig{
+		Reconnect: &Reconnect{BufferSize: 5},
+	}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ws.rawConnection.Close()
+	if ws.queue == nil || ws.queue.config.Size != 5 || ws.queue.config.Policy != QueueError {
+		t.Error("BufferSize is not applied as SendQueue")
+	}
+}
@@ -0,0 +1,272 @@
+package webson
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// RPCMessage is the private data type for rpc frames, it won't be mixed with Text & Binary messages.
+//
+// Opcode 0x3 is reserved for further data frames by RFC6455, other implementations will fail the connection with it.
+// It's only tolerable because it's sent after both sides negotiated rpc in the handshake with Config.EnableRPC,
+// so the other side is known to be webson.
+const RPCMessage = MessageType(3)
+
+const (
+	rpcRequest  = byte(1)
+	rpcResponse = byte(2)
+	rpcError    = byte(3)
+	rpcCancel   = byte(4)
+)
+
+// kind(1) | id(8) | method size(2) | method | payload
+const rpcHeaderSize = 11
+
+// max cancels kept for requests not arrived yet
+const rpcEarlyCancels = 1024
+
+// RPCHandler handles one rpc request, ctx is canceled when caller canceled or connection lost.
+// Error returned will be sent back to the caller as *RPCError.
+type RPCHandler func(ctx context.Context, payload []byte, a Adapter) ([]byte, error)
+
+type rpcFrame struct {
+	kind    byte
+	id      uint64
+	method  string
+	payload []byte
+}
+
+func (f *rpcFrame) encode() []byte {
+	raw := make([]byte, rpcHeaderSize+len(f.method)+len(f.payload))
+	raw[0] = f.kind
+	binary.BigEndian.PutUint64(raw[1:9], f.id)
+	binary.BigEndian.PutUint16(raw[9:rpcHeaderSize], uint16(len(f.method)))
+	copy(raw[rpcHeaderSize:], f.method)
+	copy(raw[rpcHeaderSize+len(f.method):], f.payload)
+	return raw
+}
+
+func decodeRPCFrame(raw []byte) (*rpcFrame, error) {
+	if len(raw) < rpcHeaderSize {
+		return nil, errors.New("rpc frame too short")
+	}
+	methodSize := int(binary.BigEndian.Uint16(raw[9:rpcHeaderSize]))
+	if len(raw) < rpcHeaderSize+methodSize {
+		return nil, errors.New("rpc method too short")
+	}
+	return &rpcFrame{
+		kind:    raw[0],
+		id:      binary.BigEndian.Uint64(raw[1:9]),
+		method:  string(raw[rpcHeaderSize : rpcHeaderSize+methodSize]),
+		payload: raw[rpcHeaderSize+methodSize:],
+	}, nil
+}
+
+// ctxReader stops reading once ctx is done, so that DispatchReader will cancel the stream
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if e := r.ctx.Err(); e != nil {
+		return 0, e
+	}
+	return r.r.Read(p)
+}
+
+// RPC is the request/response layer on a connection, both sides can Call & Handle.
+// Create it with NewRPC before Start, Config.EnableRPC should be set on both sides.
+type RPC struct {
+	con *Connection
+
+	Timeout time.Duration // default timeout for every call, 0 to be decided by ctx only
+
+	lock     sync.Mutex
+	lastId   uint64
+	handlers map[string]RPCHandler
+	calls    map[uint64]chan *rpcFrame
+	serving  map[uint64]context.CancelFunc
+	early    map[uint64]struct{} // cancels arrived before requests, msgs are handled async
+}
+
+// NewRPC creates the rpc layer and apply it to the connection
+func NewRPC(con *Connection) *RPC {
+	r := &RPC{
+		con:      con,
+		handlers: make(map[string]RPCHandler),
+		calls:    make(map[uint64]chan *rpcFrame),
+		serving:  make(map[uint64]context.CancelFunc),
+		early:    make(map[uint64]struct{}),
+	}
+	con.Apply(r)
+	return r
+}
+
+// Handle binds handler for the method, later one will replace the previous one
+func (r *RPC) Handle(method string, h RPCHandler) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.handlers[method] = h
+}
+
+// Call the method on the other side and wait for the response.
+// If ctx is done before response, the other side will be notified to cancel.
+func (r *RPC) Call(ctx context.Context, method string, payload []byte) ([]byte, error) {
+	if len(method) > 0xffff {
+		return nil, errors.New("rpc method too long")
+	}
+	if !r.con.negoSet.rpc {
+		return nil, errors.New("rpc is not negotiated")
+	}
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	reply := make(chan *rpcFrame, 1)
+	r.lock.Lock()
+	r.lastId += 1
+	id := r.lastId
+	r.calls[id] = reply
+	r.lock.Unlock()
+	defer func() {
+		r.lock.Lock()
+		delete(r.calls, id)
+		r.lock.Unlock()
+	}()
+
+	request := (&rpcFrame{kind: rpcRequest, id: id, method: method, payload: payload}).encode()
+	var e error
+	if r.con.streamable {
+		// sending large request can be canceled in the middle by canceling the stream
+		e = r.con.DispatchReader(RPCMessage, &ctxReader{ctx, bytes.NewReader(request)})
+	} else {
+		e = r.con.Dispatch(RPCMessage, request)
+	}
+	if e != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, e
+	}
+
+	select {
+	case f := <-reply:
+		if f == nil {
+			return nil, ConnectionLost{}
+		}
+		if f.kind == rpcError {
+			return nil, &RPCError{Method: method, Message: string(f.payload)}
+		}
+		return f.payload, nil
+	case <-ctx.Done():
+		// the request is sent, handler of the other side is canceled by id
+		r.con.Dispatch(RPCMessage, (&rpcFrame{kind: rpcCancel, id: id}).encode())
+		return nil, ctx.Err()
+	}
+}
+
+func (r *RPC) Name() string {
+	return "webson-rpc"
+}
+
+func (r *RPC) OnStatus(s Status, a Adapter) {
+	if s != StatusClosed && s != StatusReconnecting {
+		return
+	}
+	// other side won't respond any more
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for id, reply := range r.calls {
+		select {
+		case reply <- nil:
+		default:
+		}
+		delete(r.calls, id)
+	}
+	for id, cancel := range r.serving {
+		cancel()
+		delete(r.serving, id)
+	}
+	r.early = make(map[uint64]struct{})
+}
+
+func (r *RPC) OnMessage(m *Message, a Adapter) {
+	if m.Type != RPCMessage || m.config.negotiate == nil || !m.config.negotiate.rpc {
+		return
+	}
+	raw, e := m.readComplete()
+	if e != nil {
+		return
+	}
+	f, e := decodeRPCFrame(raw)
+	if e != nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch f.kind {
+	case rpcRequest:
+		if _, canceled := r.early[f.id]; canceled {
+			// caller is gone
+			delete(r.early, f.id)
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		r.serving[f.id] = cancel
+		go r.serve(ctx, f, r.handlers[f.method], a)
+	case rpcResponse, rpcError:
+		if reply, ok := r.calls[f.id]; ok {
+			reply <- f
+			delete(r.calls, f.id)
+		}
+	case rpcCancel:
+		if cancel, ok := r.serving[f.id]; ok {
+			cancel()
+			delete(r.serving, f.id)
+			return
+		}
+		// the request may be handled after the cancel, or it's served already
+		r.early[f.id] = struct{}{}
+		if len(r.early) > rpcEarlyCancels {
+			oldest := f.id
+			for id := range r.early {
+				if id < oldest {
+					oldest = id
+				}
+			}
+			delete(r.early, oldest)
+		}
+	}
+}
+
+func (r *RPC) serve(ctx context.Context, f *rpcFrame, h RPCHandler, a Adapter) {
+	resp := &rpcFrame{kind: rpcResponse, id: f.id}
+	if h == nil {
+		resp.kind = rpcError
+		resp.payload = []byte("method not found")
+	} else if payload, e := h(ctx, f.payload, a); e != nil {
+		resp.kind = rpcError
+		resp.payload = []byte(e.Error())
+	} else {
+		resp.payload = payload
+	}
+
+	r.lock.Lock()
+	cancel, ok := r.serving[f.id]
+	delete(r.serving, f.id)
+	r.lock.Unlock()
+	if !ok {
+		// canceled by caller, no one is waiting for it
+		return
+	}
+	cancel()
+	a.Dispatch(RPCMessage, resp.encode())
+}
@@ -0,0 +1,209 @@
+package webson
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRPC(t *testing.T) {
+	for _, c := range []struct {
+		streams bool
+		server  Config
+	}{
+		{false, Config{EnableRPC: true, EnableStreams: true}},
+		{true, Config{EnableRPC: true, EnableStreams: true}},
+		// multi-frame msgs are triggered on the first frame
+		{true, Config{EnableRPC: true, EnableStreams: true, TriggerOnStart: true}},
+		{false, Config{EnableRPC: true, TriggerOnStart: true, Synchronize: true}},
+	} {
+		streams := c.streams
+		canceled := make(chan bool, 1)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			config := c.server
+			ws, e := TakeOver(w, r, &config)
+			if e != nil {
+				return
+			}
+			rpc := NewRPC(ws)
+			rpc.Handle("upper", func(ctx context.Context, p []byte, a Adapter) ([]byte, error) {
+				return []byte(strings.ToUpper(string(p))), nil
+			})
+			rpc.Handle("fail", func(ctx context.Context, p []byte, a Adapter) ([]byte, error) {
+				return nil, errors.New("failed on purpose")
+			})
+			rpc.Handle("slow", func(ctx context.Context, p []byte, a Adapter) ([]byte, error) {
+				select {
+				case <-ctx.Done():
+					canceled <- true
+				case <-time.After(3 * time.Second):
+				}
+				return nil, nil
+			})
+			ws.OnReady(func(a Adapter) {
+				// server side can call client too
+				resp, e := rpc.Call(context.Background(), "lower", []byte("WEBSON"))
+				if e != nil || string(resp) != "webson" {
+					t.Errorf("unexpected server call %s %v", resp, e)
+				}
+			})
+			ws.Start()
+		}))
+
+		ws, e := Dial(s.URL, &DialConfig{Config: Config{EnableRPC: true, EnableStreams: streams}})
+		if e != nil {
+			t.Fatal(e)
+		}
+		if ws.streamable != (streams && c.server.EnableStreams) {
+			t.Fatal("unexpected streamable")
+		}
+		rpc := NewRPC(ws)
+		rpc.Handle("lower", func(ctx context.Context, p []byte, a Adapter) ([]byte, error) {
+			return []byte(strings.ToLower(string(p))), nil
+		})
+		go ws.Start()
+		time.Sleep(10 * time.Millisecond)
+
+		ctx := context.Background()
+		if resp, e := rpc.Call(ctx, "upper", []byte("webson")); e != nil || string(resp) != "WEBSON" {
+			t.Errorf("unexpected response %s %v", resp, e)
+		}
+		// larger than ChunkSize
+		large := strings.Repeat("webson", 2000)
+		if resp, e := rpc.Call(ctx, "upper", []byte(large)); e != nil || string(resp) != strings.ToUpper(large) {
+			t.Errorf("unexpected response %d %v", len(resp), e)
+		}
+		var re *RPCError
+		if _, e := rpc.Call(ctx, "fail", nil); !errors.As(e, &re) || re.Message != "failed on purpose" {
+			t.Errorf("unexpected error %v", e)
+		}
+		if _, e := rpc.Call(ctx, "missing", nil); !errors.As(e, &re) {
+			t.Errorf("unexpected error %v", e)
+		}
+
+		timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		if _, e := rpc.Call(timeout, "slow", nil); e != context.DeadlineExceeded {
+			t.Errorf("unexpected error %v", e)
+		}
+		cancel()
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			t.Error("cancel not received by handler")
+		}
+
+		// connection lost for pending calls
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			ws.Close()
+		}()
+		if _, e := rpc.Call(ctx, "slow", nil); e != (ConnectionLost{}) {
+			t.Errorf("unexpected error %v", e)
+		}
+		s.Close()
+	}
+}
+
+func TestRPCNegotiate(t *testing.T) {
+	handled := make(chan bool, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, &Config{EnableRPC: true})
+		if e != nil {
+			return
+		}
+		NewRPC(ws).Handle("echo", func(ctx context.Context, p []byte, a Adapter) ([]byte, error) {
+			handled <- true
+			return p, nil
+		})
+		ws.Start()
+	}))
+	defer s.Close()
+	// the client doesn't enable rpc, no rpc frames in both directions
+	ws, e := Dial(s.URL, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	rpc := NewRPC(ws)
+	go ws.Start()
+	defer ws.Close()
+	time.Sleep(10 * time.Millisecond)
+	if ws.negoSet.rpc {
+		t.Error("rpc is negotiated")
+	}
+	if _, e := rpc.Call(context.Background(), "echo", nil); e == nil {
+		t.Error("call without negotiation")
+	}
+	// reserved opcode from the other side is ignored
+	ws.Dispatch(RPCMessage, (&rpcFrame{kind: rpcRequest, id: 1, method: "echo"}).encode())
+	select {
+	case <-handled:
+		t.Error("rpc is handled without negotiation")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRPCCancel(t *testing.T) {
+	started := make(chan bool, 1)
+	canceled := make(chan bool, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, &Config{EnableRPC: true})
+		if e != nil {
+			return
+		}
+		NewRPC(ws).Handle("wait", func(ctx context.Context, p []byte, a Adapter) ([]byte, error) {
+			started <- true
+			select {
+			case <-ctx.Done():
+				canceled <- true
+			case <-time.After(3 * time.Second):
+			}
+			return nil, nil
+		})
+		ws.Start()
+	}))
+	defer s.Close()
+	ws, e := Dial(s.URL, &DialConfig{Config: Config{EnableRPC: true}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	rpc := NewRPC(ws)
+	go ws.Start()
+	defer ws.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	// canceled after the request is handled by the other side
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, e := rpc.Call(ctx, "wait", nil); e != context.Canceled {
+		t.Errorf("unexpected error %v", e)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("handler ctx is not canceled")
+	}
+
+	// cancel may be handled before the request
+	handled := false
+	early := NewRPC(&Connection{})
+	early.Handle("wait", func(ctx context.Context, p []byte, a Adapter) ([]byte, error) {
+		handled = true
+		return nil, nil
+	})
+	for _, f := range []*rpcFrame{{kind: rpcCancel, id: 1}, {kind: rpcRequest, id: 1, method: "wait"}} {
+		m := &Message{Type: RPCMessage, config: &msgConfig{negotiate: &negoSet{rpc: true}}, receive: &msgReceivedStatus{}}
+		m.entity.Write(f.encode())
+		early.OnMessage(m, nil)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if handled || len(early.early) != 0 || len(early.serving) != 0 {
+		t.Error("canceled request is handled")
+	}
+}
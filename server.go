@@ -3,6 +3,8 @@ package webson
 import (
 	"errors"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
 	"strings"
 )
@@ -40,10 +42,32 @@ func TakeOver(w http.ResponseWriter, r *http.Request, c *Config) (*Connection, e
 	if c == nil {
 		c = &Config{}
 	}
+	if !c.checkOrigin(r) {
+		sendHTTPError(w, http.StatusForbidden)
+		return nil, errors.New("origin not allowed")
+	}
 	if c.HeaderVerify != nil && !c.HeaderVerify(header) {
 		sendHTTPError(w, http.StatusUnauthorized)
 		return nil, errors.New("header verify not passed")
 	}
+	extraHeaders := make(http.Header)
+	if c.UpgradeVerify != nil {
+		if e := c.UpgradeVerify(r, extraHeaders); e != nil {
+			var reject *UpgradeError
+			if !errors.As(e, &reject) {
+				reject = &UpgradeError{http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized)}
+			}
+			for k, vs := range extraHeaders {
+				w.Header()[k] = vs
+			}
+			http.Error(w, reject.Body, reject.Code)
+			return nil, e
+		}
+		if !validHeaders(extraHeaders) {
+			sendHTTPError(w, http.StatusInternalServerError)
+			return nil, errors.New("invalid header from UpgradeVerify")
+		}
+	}
 	if e := c.setup(); e != nil {
 		sendHTTPError(w, http.StatusInternalServerError)
 		return nil, e
@@ -68,15 +92,42 @@ func TakeOver(w http.ResponseWriter, r *http.Request, c *Config) (*Connection, e
 			verified["Webson-Max-Streams"] = strconv.Itoa(maxStreams)
 		}
 	}
-	compressable := false
+	nego := negoSet{
+		streamable: streamable,
+		maxStreams: maxStreams,
+	}
+	if streamable && c.StreamWindow > 0 {
+		// flow control only when both sides give windows
+		if clientWindow, e := strconv.Atoi(header.Get("Webson-Stream-Window")); e == nil && clientWindow > 0 {
+			nego.sendWindow = clientWindow
+			nego.recvWindow = c.StreamWindow
+			verified["Webson-Stream-Window"] = strconv.Itoa(c.StreamWindow)
+		}
+	}
+	// private types with reserved opcodes are only sent after both sides agreed
+	if c.EnableRPC && header.Get("Webson-Rpc") == "1" {
+		nego.rpc = true
+		verified["Webson-Rpc"] = "1"
+	}
+	if c.EnableCluster && header.Get("Webson-Cluster") == "1" {
+		nego.cluster = true
+		verified["Webson-Cluster"] = "1"
+	}
+	if subprotocol := c.selectSubprotocol(header); subprotocol != "" {
+		nego.subprotocol = subprotocol
+		verified["Sec-Websocket-Protocol"] = subprotocol
+	}
 	if c.EnableCompress {
-		if strings.Contains(strings.ToLower(strings.Join(header.Values("Sec-Websocket-Extensions"), " ")),
-			"permessage-deflate") {
-			compressable = true
-			verified["Sec-Websocket-Extensions"] = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
-			if c.CompressLevel == 0 {
-				c.CompressLevel = DEFAULT_COMPRESS_LEVEL
+		// accept the first valid offer
+		offers, errs := parseDeflateParams(header.Values("Sec-Websocket-Extensions"))
+		for i, offer := range offers {
+			if errs[i] != nil {
+				continue
 			}
+			resp := c.acceptDeflate(offer, streamable)
+			nego.deflateSet(resp, c.CompressLevel, false)
+			verified["Sec-Websocket-Extensions"] = resp.String()
+			break
 		}
 	}
 
@@ -98,6 +149,14 @@ func TakeOver(w http.ResponseWriter, r *http.Request, c *Config) (*Connection, e
 	for h, v := range verified {
 		resp += h + ": " + v + "\r\n"
 	}
+	for h, vs := range extraHeaders {
+		if _, reserved := verified[http.CanonicalHeaderKey(h)]; reserved {
+			continue
+		}
+		for _, v := range vs {
+			resp += h + ": " + v + "\r\n"
+		}
+	}
 
 	if _, e := wsCon.Write([]byte(resp + "\r\n")); e != nil {
 		wsCon.Close()
@@ -106,20 +165,71 @@ func TakeOver(w http.ResponseWriter, r *http.Request, c *Config) (*Connection, e
 
 	con := &Connection{
 		rawConnection: wsCon,
+		request:       r,
 
-		config: c,
-		negoSet: negoSet{
-			streamable: streamable,
-			maxStreams: maxStreams,
-
-			compressable:  compressable,
-			compressLevel: c.CompressLevel,
-		},
+		config:  c,
+		negoSet: nego,
+	}
+	if e := con.prepare(); e != nil {
+		wsCon.Close()
+		return nil, e
 	}
-	con.prepare()
 	return con, nil
 }
 
+// checkOrigin allows requests without Origin (not from browsers), same origin or AllowedOrigins
+func (c *Config) checkOrigin(r *http.Request) bool {
+	if c.CheckOrigin != nil {
+		return c.CheckOrigin(r)
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, e := url.Parse(origin)
+	if e != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, pattern := range c.AllowedOrigins {
+		target := u.Host
+		if strings.Contains(pattern, "://") {
+			target = u.Scheme + "://" + u.Host
+		}
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(target)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// selectSubprotocol choose the first client offered subprotocol which is supported
+func (c *Config) selectSubprotocol(header http.Header) string {
+	offered := parseTokens(header.Values("Sec-Websocket-Protocol"))
+	if len(offered) == 0 {
+		return ""
+	}
+	if c.SelectSubprotocol != nil {
+		selected := c.SelectSubprotocol(offered)
+		for _, p := range offered {
+			if p == selected {
+				return p
+			}
+		}
+		return ""
+	}
+	for _, p := range offered {
+		for _, s := range c.Subprotocols {
+			if p == s {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
 func sendHTTPError(w http.ResponseWriter, code int) {
 	http.Error(w, http.StatusText(code), code)
 }
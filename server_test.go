@@ -1,7 +1,11 @@
 package webson
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 )
 
@@ -21,3 +25,122 @@ func TestService(t *testing.T) {
 		t.Error(e)
 	}
 }
+
+func TestCheckOrigin(t *testing.T) {
+	c := &Config{AllowedOrigins: []string{"*.trusted.com", "https://app.partner.com"}}
+	for origin, allowed := range map[string]bool{
+		"":                         true,
+		"http://webson.local":      true,
+		"https://a.trusted.com":    true,
+		"https://app.partner.com":  true,
+		"http://app.partner.com":   false,
+		"https://evil.com":         false,
+		"https://trusted.com.evil": false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://webson.local/", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if c.checkOrigin(r) != allowed {
+			t.Errorf("origin %q should be allowed: %v", origin, allowed)
+		}
+	}
+}
+
+func TestUpgradeVerify(t *testing.T) {
+	paths := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, &Config{
+			UpgradeVerify: func(r *http.Request, resp http.Header) error {
+				switch r.URL.Query().Get("token") {
+				case "ok":
+				case "wrapped":
+					return fmt.Errorf("token rejected: %w", &UpgradeError{http.StatusTooManyRequests, "slow down"})
+				default:
+					return &UpgradeError{http.StatusTooManyRequests, "slow down"}
+				}
+				resp.Set("Set-Cookie", "session=webson")
+				return nil
+			},
+		})
+		if e != nil {
+			return
+		}
+		paths <- ws.Request().URL.Path
+		ws.Close()
+		ws.Start()
+	}))
+	defer s.Close()
+
+	// wrapped UpgradeError is used as well
+	for _, token := range []string{"no", "wrapped"} {
+		r, _ := http.NewRequest(http.MethodGet, s.URL+"/?token="+token, nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-Websocket-Version", "13")
+		r.Header.Set("Sec-Websocket-Key", createChallengeKey())
+		resp, e := http.DefaultClient.Do(r)
+		if e != nil {
+			t.Fatal(e)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("unexpected status %d of %s", resp.StatusCode, token)
+		}
+	}
+
+	ws, e := Dial(s.URL+"/ws?token=ok", &DialConfig{Config: Config{
+		HeaderVerify: func(h http.Header) bool {
+			return h.Get("Set-Cookie") == "session=webson"
+		},
+	}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ws.rawConnection.Close()
+	if p := <-paths; p != "/ws" {
+		t.Errorf("unexpected request path %s", p)
+	}
+}
+
+func TestUpgradeVerifyInjection(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, &Config{
+			UpgradeVerify: func(r *http.Request, resp http.Header) error {
+				// header built from request data
+				resp["X-Trace-Id"] = []string{r.URL.Query().Get("trace")}
+				return nil
+			},
+		})
+		if e != nil {
+			return
+		}
+		ws.Close()
+		ws.Start()
+	}))
+	defer s.Close()
+
+	for trace, valid := range map[string]bool{
+		"abc\tdef":                   true,
+		"abc\r\nSet-Cookie: admin=1": false,
+		"abc\nSet-Cookie: admin=1":   false,
+		"abc\r\n\r\nHTTP/1.1 200 OK": false,
+	} {
+		ws, e := Dial(s.URL+"/?trace="+url.QueryEscape(trace), nil)
+		if valid {
+			if e != nil {
+				t.Errorf("valid header %q rejected: %v", trace, e)
+				continue
+			}
+			ws.rawConnection.Close()
+			continue
+		}
+		var he *HandshakeError
+		if !errors.As(e, &he) || he.StatusCode != http.StatusInternalServerError || he.Header.Get("Set-Cookie") != "" {
+			t.Errorf("header %q is not rejected: %v", trace, e)
+		}
+	}
+	if validHeaders(http.Header{"Bad Name": {"v"}}) || validHeaders(http.Header{"Bad:Name": {"v"}}) {
+		t.Error("invalid header name accepted")
+	}
+}
@@ -18,4 +18,8 @@ const (
 	// handshake, wait for close, pong, etc.
 	// This state may be triggered for multiple times from recovery to timeout.
 	StatusTimeout = Status(2)
+
+	// StatusReconnecting is the state when client connection is lost and trying to reconnect.
+	// Connection will be StatusReady after reconnected, or StatusClosed if failed.
+	StatusReconnecting = Status(3)
 )
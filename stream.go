@@ -0,0 +1,239 @@
+package webson
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// StreamMessage is the private data type for frames of Stream, it's only used with streams.
+// Every Stream is two long lived messages, one for each direction.
+const StreamMessage = MessageType(6)
+
+const (
+	streamOpen  = byte(1) // kind(1)
+	streamReply = byte(2) // kind(1) | opener stream id(2)
+)
+
+// Stream is a bidirectional channel on a streamable connection, see Connection.OpenStream & Connection.AcceptStream.
+// Every Write is sent at once, Close ends writing & the other side reads io.EOF after the rest.
+type Stream struct {
+	sessions *streamSessions
+	w        *MessageWriter
+	wLock    sync.Mutex
+
+	ready chan struct{} // closed when read half is attached
+	r     *frameChunks
+}
+
+// streamSessions keeps Streams of a connection
+type streamSessions struct {
+	con      *Connection
+	lock     sync.Mutex
+	opened   map[int]*Stream // opened by this side & waiting for reply, by stream id of the write half
+	accepted chan *Stream
+	done     chan struct{}
+	closed   bool
+}
+
+func (con *Connection) setupSessions() {
+	if con.sessions != nil {
+		con.sessions.close()
+	}
+	con.sessions = nil
+	if !con.streamable {
+		return
+	}
+	con.sessions = &streamSessions{
+		con:      con,
+		opened:   make(map[int]*Stream),
+		accepted: make(chan *Stream, con.maxStreams),
+		done:     make(chan struct{}),
+	}
+}
+
+// OpenStream opens a Stream, the other side gets it by AcceptStream. Streams only work on streamable connection.
+func (con *Connection) OpenStream() (*Stream, error) {
+	ss := con.sessions
+	if ss == nil {
+		return nil, errors.New("streams are not enabled")
+	}
+	return ss.open([]byte{streamOpen}, nil)
+}
+
+// AcceptStream waits for the next Stream opened by the other side
+func (con *Connection) AcceptStream(ctx context.Context) (*Stream, error) {
+	ss := con.sessions
+	if ss == nil {
+		return nil, errors.New("streams are not enabled")
+	}
+	select {
+	case s := <-ss.accepted:
+		return s, nil
+	case <-ss.done:
+		return nil, io.EOF
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// open the write half with header sent, reply streams are attached with the read half at once
+func (ss *streamSessions) open(header []byte, r *frameChunks) (*Stream, error) {
+	w, e := ss.con.NextWriter(StreamMessage)
+	if e != nil {
+		return nil, e
+	}
+	// Stream payload is sent as it is, frames are flushed by every Write
+	w.msg.send.doCompress, w.c = false, nil
+	s := &Stream{sessions: ss, w: w, ready: make(chan struct{})}
+	if r != nil {
+		s.attach(r)
+	} else {
+		// reply may come before header is written
+		ss.lock.Lock()
+		ss.opened[w.msg.send.streamId] = s
+		ss.lock.Unlock()
+	}
+	w.Write(header)
+	if e := w.Flush(); e != nil {
+		ss.forget(s)
+		w.release()
+		return nil, e
+	}
+	return s, nil
+}
+
+// arrive handles the first frame of StreamMessage from other side, called by read loop
+func (ss *streamSessions) arrive(m *Message) {
+	header := m.entity.Bytes()
+	opening := len(header) >= 1 && header[0] == streamOpen
+	var s *Stream
+	var data []byte
+	switch {
+	case opening:
+		data = header[1:]
+	case len(header) >= 3 && header[0] == streamReply:
+		data = header[3:]
+		id := int(binary.BigEndian.Uint16(header[1:3]))
+		ss.lock.Lock()
+		s = ss.opened[id]
+		delete(ss.opened, id)
+		ss.lock.Unlock()
+	}
+	r := m.chunks(data, nil)
+	r.eof = m.isComplete
+	m.receive.updateLock.Lock()
+	m.receive.session = true
+	m.receive.reader = r
+	m.receive.updateLock.Unlock()
+
+	if opening {
+		reply := make([]byte, 3)
+		reply[0] = streamReply
+		binary.BigEndian.PutUint16(reply[1:], uint16(m.receive.streamId))
+		s, e := ss.open(reply, r)
+		if e != nil {
+			r.close()
+			return
+		}
+		select {
+		case ss.accepted <- s:
+		default:
+			// too many streams not accepted
+			s.Cancel()
+		}
+		return
+	}
+	if s == nil {
+		// unknown or closed stream, frames are dropped
+		r.close()
+		return
+	}
+	s.attach(r)
+}
+
+func (ss *streamSessions) forget(s *Stream) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	delete(ss.opened, s.w.msg.send.streamId)
+}
+
+// close wakes up Streams waiting for reply & AcceptStream after connection is closed
+func (ss *streamSessions) close() {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if !ss.closed {
+		ss.closed = true
+		close(ss.done)
+	}
+}
+
+func (s *Stream) attach(r *frameChunks) {
+	s.sessions.lock.Lock()
+	defer s.sessions.lock.Unlock()
+	s.r = r
+	close(s.ready)
+}
+
+func (s *Stream) reader() *frameChunks {
+	select {
+	case <-s.ready:
+	case <-s.sessions.done:
+	}
+	s.sessions.lock.Lock()
+	defer s.sessions.lock.Unlock()
+	return s.r
+}
+
+// Read data written by the other side, io.EOF after the other side closed
+func (s *Stream) Read(p []byte) (int, error) {
+	r := s.reader()
+	if r == nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return r.Read(p)
+}
+
+// Write sends p at once, frames are sent by ChunkSize
+func (s *Stream) Write(p []byte) (int, error) {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+	n, e := s.w.Write(p)
+	if e != nil {
+		return n, e
+	}
+	if e := s.w.Flush(); e != nil {
+		return 0, e
+	}
+	return n, nil
+}
+
+// SetPriority of frames written by this side, Connection.SetPriority of StreamMessage is the default
+func (s *Stream) SetPriority(priority int) {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+	s.w.SetPriority(priority)
+}
+
+// Close ends writing, data from the other side can still be read until io.EOF
+func (s *Stream) Close() error {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+	return s.w.Close()
+}
+
+// Cancel aborts the Stream, the other side fails reading. Data not read yet is dropped.
+func (s *Stream) Cancel() error {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+	s.sessions.forget(s)
+	s.sessions.lock.Lock()
+	r := s.r
+	s.sessions.lock.Unlock()
+	if r != nil {
+		r.close()
+	}
+	return s.w.CloseWithError(errors.New("stream canceled"))
+}
@@ -0,0 +1,108 @@
+package webson
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	config := &Config{EnableStreams: true, EnableCompress: true}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, e := TakeOver(w, r, config)
+		if e != nil {
+			return
+		}
+		go func() {
+			for {
+				st, e := ws.AcceptStream(context.Background())
+				if e != nil {
+					return
+				}
+				// echo until the other side closed
+				go func() {
+					io.Copy(st, st)
+					st.Close()
+				}()
+			}
+		}()
+		ws.Start()
+	}))
+	defer s.Close()
+
+	ws, e := Dial(s.URL, &DialConfig{Config: *config})
+	if e != nil {
+		t.Fatal(e)
+	}
+	ready := make(chan struct{})
+	ws.OnReady(func(a Adapter) {
+		close(ready)
+	})
+	go ws.Start()
+	defer ws.Close()
+	<-ready
+
+	var wg sync.WaitGroup
+	for _, size := range []int{10, 100 * 1024, 300 * 1024} {
+		wg.Add(1)
+		go func(size int) {
+			defer wg.Done()
+			st, e := ws.OpenStream()
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			payload := make([]byte, size)
+			rand.Read(payload)
+			go func() {
+				st.Write(payload[:size/2])
+				st.Write(payload[size/2:])
+				st.Close()
+			}()
+			echo, e := io.ReadAll(st)
+			if e != nil {
+				t.Error(e)
+			}
+			if !bytes.Equal(echo, payload) {
+				t.Errorf("unexpected echo %d, expect %d", len(echo), size)
+			}
+		}(size)
+	}
+	wg.Wait()
+
+	// canceled stream fails the other side
+	st, e := ws.OpenStream()
+	if e != nil {
+		t.Fatal(e)
+	}
+	st.Write([]byte("webson"))
+	buf := make([]byte, 6)
+	if _, e := io.ReadFull(st, buf); e != nil || string(buf) != "webson" {
+		t.Fatal("echo failed", e)
+	}
+	st.Cancel()
+	if _, e := st.Read(buf); e == nil {
+		t.Error("read after cancel")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, e := ws.AcceptStream(ctx); e != context.DeadlineExceeded {
+		t.Error("no stream should be accepted", e)
+	}
+
+	plain, e := Dial(newEchoServer(t, &Config{}).URL, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer plain.Close()
+	if _, e := plain.OpenStream(); e == nil {
+		t.Error("streams without negotiation")
+	}
+}
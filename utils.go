@@ -1,10 +1,14 @@
 package webson
 
 import (
+	"bufio"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
 	"io"
+	"net"
+	"net/http"
+	"strings"
 )
 
 func magicDigest(challengeKey string, magic []byte) string {
@@ -33,6 +37,55 @@ func createMask() []byte {
 	return mask
 }
 
+// parseTokens split comma separated header values
+func parseTokens(values []string) []string {
+	var tokens []string
+	for _, value := range values {
+		for _, t := range strings.Split(value, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+// validHeaders checks header names are tokens & values have no control chars except tab, see RFC7230,
+// so that headers written to the raw response can't inject more headers or split the response.
+func validHeaders(h http.Header) bool {
+	for k, vs := range h {
+		if k == "" {
+			return false
+		}
+		for _, c := range []byte(k) {
+			if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+				return false
+			}
+		}
+		for _, v := range vs {
+			for _, c := range []byte(v) {
+				if (c < ' ' && c != '\t') || c == 0x7f {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// bufferedConn reads from the buffer first, for data already read with handshake
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
 func exceptEOF(e error) error {
 	if e == io.EOF {
 		return nil
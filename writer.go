@@ -0,0 +1,204 @@
+package webson
+
+import (
+	"errors"
+)
+
+// MessageWriter writes one message frame by frame, see Connection.NextWriter
+type MessageWriter struct {
+	con *Connection
+	msg *Message
+	c   *compressor
+
+	buf        []byte
+	isFirst    bool
+	locked     bool // holding msgLock for the whole message if not streamable, writeLock is held by each frame
+	terminated bool // final or cancel frame is sent, stream id is released by it
+	done       bool
+	err        error
+}
+
+// NextWriter starts a message to be written by the returned writer, a frame is sent whenever ChunkSize is filled,
+// and the final frame is sent on Close. It's for producers pushing data, like encoders or io.Copy.
+//
+// The stream id is reserved until the writer is closed on streamable connection, other messages can be sent meanwhile.
+//
+// Without streams, the writer holds the connection for data messages until it's closed, other data messages
+// (including Dispatch, DispatchReader & pool broadcasts) will wait, so always Close the writer, even after errors.
+// The connection is released between frames for control frames only, so that ping, pong & close
+// can still be sent between fragments (RFC6455 5.4).
+// Writers are not safe for concurrent use.
+func (con *Connection) NextWriter(t MessageType) (*MessageWriter, error) {
+	if e := con.writable(); e != nil {
+		return nil, e
+	}
+	m := &Message{Type: t}
+	if m.IsControl() {
+		return nil, errors.New("control message can't be written by writer")
+	}
+	if e := con.patchMsg(m); e != nil {
+		return nil, e
+	}
+	w := &MessageWriter{con: con, msg: m, isFirst: true}
+	if !con.streamable {
+		con.msgLock.Lock()
+		w.locked = true
+	}
+	if m.send.doCompress {
+		c, e := con.compressorFor()
+		if e != nil {
+			w.release()
+			return nil, e
+		}
+		w.c = c
+	}
+	return w, nil
+}
+
+// SetPriority of frames written after, Connection.SetPriority of the type is the default.
+// It only works on streamable connection.
+func (w *MessageWriter) SetPriority(priority int) {
+	w.msg.send.priority = priority
+}
+
+func (w *MessageWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.New("write to closed writer")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	chunkSize := w.con.config.ChunkSize
+	sent := 0
+	for len(w.buf)-sent > chunkSize {
+		if e := w.flush(w.buf[sent:sent+chunkSize], false, false); e != nil {
+			return 0, e
+		}
+		sent += chunkSize
+	}
+	w.buf = w.buf[:copy(w.buf, w.buf[sent:])]
+	return len(p), nil
+}
+
+// Flush sends buffered data as a frame without ending the message
+func (w *MessageWriter) Flush() error {
+	if w.done {
+		return errors.New("write to closed writer")
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if e := w.flush(w.buf, false, false); e != nil {
+		return e
+	}
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close sends the rest as the final frame
+func (w *MessageWriter) Close() error {
+	if w.done {
+		return w.err
+	}
+	if w.err == nil {
+		w.flush(w.buf, true, false)
+	}
+	w.release()
+	return w.err
+}
+
+// CloseWithError aborts the message. The stream is canceled on streamable connection,
+// or the connection is closed with InternalServerErr if frames have been sent, since the message can't be ended otherwise.
+func (w *MessageWriter) CloseWithError(err error) error {
+	if w.done {
+		return w.err
+	}
+	if err == nil {
+		err = errors.New("message aborted")
+	}
+	closeConnection := false
+	if w.err == nil && !w.isFirst {
+		if w.msg.send.streamlize {
+			w.flush(nil, false, true)
+		} else {
+			closeConnection = true
+		}
+	}
+	if closeConnection {
+		// close frame can be sent between fragments while holding the connection
+		reason := err.Error()
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		closeMsg := &Message{Type: CloseMessage, payload: (&CloseCode{InternalServerErr, reason}).toBytes()}
+		if w.con.patchMsg(closeMsg) == nil {
+			closeMsg.isFirst, closeMsg.isComplete = true, true
+			w.con.writeLock.Lock()
+			w.con.writeSingleFrame(closeMsg)
+			w.con.writeLock.Unlock()
+		}
+	}
+	w.err = err
+	w.release()
+	if closeConnection {
+		w.con.closeUpdate()
+	}
+	return nil
+}
+
+// flush one frame, the writer fails after any error
+func (w *MessageWriter) flush(chunk []byte, last, cancel bool) error {
+	frame := w.msg.spawnVessel()
+	frame.payload = chunk
+	frame.isFirst = w.isFirst
+	frame.isComplete = last
+	if w.c != nil && !cancel {
+		var e error
+		// chunks are compressed in one deflate stream
+		if frame.payload, e = w.c.compress(chunk, last); e != nil {
+			w.err = e
+			return e
+		}
+	}
+	w.terminated = last || cancel
+	if cancel {
+		frame.send = &msgSendOptions{
+			streamlize:   true,
+			streamId:     w.msg.send.streamId,
+			cancelStream: true,
+			priority:     w.msg.send.priority,
+			doMask:       w.msg.send.doMask,
+		}
+	}
+	if w.locked {
+		w.con.writeLock.Lock()
+	}
+	e := w.con.writeSingleFrame(frame)
+	if w.locked {
+		w.con.writeLock.Unlock()
+	}
+	if e != nil {
+		w.err = e
+		return e
+	}
+	w.isFirst = false
+	return nil
+}
+
+// release the connection or stream id held by the writer
+func (w *MessageWriter) release() {
+	if w.done {
+		return
+	}
+	w.done = true
+	if w.locked {
+		w.con.msgLock.Unlock()
+	}
+	if w.msg.send.streamlize && !w.terminated {
+		w.con.releaseStream(w.msg.send.streamId)
+	}
+}
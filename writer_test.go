@@ -0,0 +1,155 @@
+package webson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextWriter(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		config Config
+	}{
+		{"plain", Config{}},
+		{"compress takeover", Config{EnableCompress: true}},
+		{"streams", Config{EnableStreams: true, EnableCompress: true}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			config := c.config
+			config.Synchronize = true
+			s := newEchoServer(t, &config)
+			ws, e := Dial(s.URL, &DialConfig{Config: config})
+			if e != nil {
+				t.Fatal(e)
+			}
+			received := make(chan []byte, 3)
+			ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+				msg, _ := m.Read()
+				received <- msg
+			})
+			ready := make(chan struct{})
+			ws.OnReady(func(a Adapter) {
+				close(ready)
+			})
+			go ws.Start()
+			defer ws.Close()
+			<-ready
+
+			// aborted message is never received
+			w, e := ws.NextWriter(TextMessage)
+			if e != nil {
+				t.Fatal(e)
+			}
+			w.Write(bytes.Repeat([]byte("x"), 10000))
+			if c.config.EnableStreams {
+				w.CloseWithError(errors.New("abort"))
+				if _, e := w.Write([]byte("x")); e == nil {
+					t.Error("write after abort")
+				}
+			} else {
+				w.Close()
+				<-received
+			}
+
+			var items []string
+			for i := 0; i < 2000; i++ {
+				items = append(items, "webson")
+			}
+			w, e = ws.NextWriter(TextMessage)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if e := json.NewEncoder(w).Encode(items); e != nil {
+				t.Fatal(e)
+			}
+			if e := w.Close(); e != nil {
+				t.Fatal(e)
+			}
+			expect, _ := json.Marshal(items)
+			select {
+			case msg := <-received:
+				if !bytes.Equal(bytes.TrimSpace(msg), expect) {
+					t.Errorf("unexpected msg %d, expect %d", len(msg), len(expect))
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("echo timeout")
+			}
+			if len(ws.inUseStreams) != 0 {
+				t.Errorf("stream ids are not released %v", ws.inUseStreams)
+			}
+		})
+	}
+}
+
+func TestNextWriterControl(t *testing.T) {
+	// echoes are received in order
+	s := newEchoServer(t, &Config{Synchronize: true})
+	ws, e := Dial(s.URL, &DialConfig{Config: Config{Synchronize: true}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	received := make(chan []byte, 2)
+	ws.OnMessage(TextMessage, func(m *Message, a Adapter) {
+		msg, _ := m.Read()
+		received <- msg
+	})
+	pong := make(chan struct{}, 1)
+	ws.OnMessage(PongMessage, func(m *Message, a Adapter) {
+		pong <- struct{}{}
+	})
+	ready := make(chan struct{})
+	ws.OnReady(func(a Adapter) {
+		close(ready)
+	})
+	go ws.Start()
+	defer ws.Close()
+	<-ready
+
+	w, e := ws.NextWriter(TextMessage)
+	if e != nil {
+		t.Fatal(e)
+	}
+	w.Write([]byte("first "))
+	if e := w.Flush(); e != nil {
+		t.Fatal(e)
+	}
+	// control frames are sent between fragments
+	if e := ws.Dispatch(PingMessage, []byte("ping")); e != nil {
+		t.Fatal(e)
+	}
+	select {
+	case <-pong:
+	case <-time.After(time.Second):
+		t.Fatal("pong not received while writing")
+	}
+	// data msgs wait until the writer is closed
+	dispatched := make(chan error, 1)
+	go func() {
+		dispatched <- ws.Dispatch(TextMessage, []byte("second"))
+	}()
+	select {
+	case <-dispatched:
+		t.Fatal("data msg is sent while writing")
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.Write([]byte("msg"))
+	if e := w.Close(); e != nil {
+		t.Fatal(e)
+	}
+	if e := <-dispatched; e != nil {
+		t.Fatal(e)
+	}
+	for _, expect := range []string{"first msg", "second"} {
+		select {
+		case msg := <-received:
+			if string(msg) != expect {
+				t.Errorf("unexpected msg %s, expect %s", msg, expect)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("echo timeout")
+		}
+	}
+}